@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Disconnect reasons, mapped to RADIUS Acct-Terminate-Cause
+const (
+	REASON_USER_REQUEST = "user_request"
+	REASON_LOST_CARRIER = "lost_carrier"
+	REASON_IDLE_TIMEOUT = "idle_timeout"
+	REASON_ADMIN_RESET = "admin_reset"
+	REASON_NAS_REQUEST = "nas_request"
+	REASON_REVOKED = "revoked"
+)
+
+var TERMINATE_CAUSES = map[string]uint32{
+	REASON_USER_REQUEST: 1,
+	REASON_LOST_CARRIER: 2,
+	REASON_IDLE_TIMEOUT: 4,
+	REASON_ADMIN_RESET: 6,
+	REASON_NAS_REQUEST: 10,
+	REASON_REVOKED: 6,
+}
+
+// RFC 2866 accounting
+const (
+	RADIUS_ACCOUNTING_REQUEST = 4
+	RADIUS_ACCOUNTING_RESPONSE = 5
+
+	RADIUS_USER_NAME = 1
+	RADIUS_FRAMED_IP_ADDRESS = 8
+	RADIUS_CALLING_STATION_ID = 31
+	RADIUS_NAS_IDENTIFIER = 32
+	RADIUS_ACCT_STATUS_TYPE = 40
+	RADIUS_ACCT_INPUT_OCTETS = 42
+	RADIUS_ACCT_OUTPUT_OCTETS = 43
+	RADIUS_ACCT_SESSION_ID = 44
+	RADIUS_ACCT_AUTHENTIC = 45
+	RADIUS_ACCT_SESSION_TIME = 46
+	RADIUS_ACCT_INPUT_PACKETS = 47
+	RADIUS_ACCT_OUTPUT_PACKETS = 48
+	RADIUS_ACCT_TERMINATE_CAUSE = 49
+	RADIUS_ACCT_INPUT_GIGAWORDS = 52
+	RADIUS_ACCT_OUTPUT_GIGAWORDS = 53
+	RADIUS_EVENT_TIMESTAMP = 55
+	RADIUS_FRAMED_IPV6_PREFIX = 97
+	RADIUS_FRAMED_IPV6_ADDRESS = 168
+
+	RADIUS_STATUS_START = 1
+	RADIUS_STATUS_STOP = 2
+	RADIUS_AUTHENTIC_LOCAL = 2
+
+	RADIUS_RETRIES = 3
+)
+
+// Wait for a response before sending again, shortened by tests
+var radius_timeout = 3 * time.Second
+
+type accountingRecord struct {
+	SessionId string `json:"session_id"`
+	User string `json:"user"`
+	Auth string `json:"auth"`
+	Subject string `json:"subject,omitempty"`
+	Groups[] string `json:"groups,omitempty"`
+	Remote string `json:"remote"`
+	Addresses[] netip.Prefix `json:"addresses"`
+	Start time.Time `json:"start"`
+	Stop time.Time `json:"stop"`
+	RxBytes int `json:"rx_bytes"`
+	TxBytes int `json:"tx_bytes"`
+	RxPackets int `json:"rx_packets"`
+	TxPackets int `json:"tx_packets"`
+	Reason string `json:"reason"`
+}
+
+var accounting struct {
+	file *os.File
+	lock sync.Mutex
+	radius_id uint8
+}
+
+func accounting_init() {
+	if cfg.accounting_file == "" { return }
+
+	f, err := os.OpenFile(cfg.accounting_file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil { log_fatal("Cant open accounting file %s: %s", cfg.accounting_file, err.Error()) }
+	accounting.file = f
+}
+
+func (c *Connection) session_id() string {
+	return fmt.Sprintf("%08x-%d", c.time.Unix(), c.id)
+}
+
+// Map the error ending the request stream to a disconnect reason
+func get_disconnect_reason(err error) string {
+	if errors.Is(err, io.EOF) { return REASON_USER_REQUEST }
+	var stream_err *quic.StreamError
+	if errors.As(err, &stream_err) {
+		if stream_err.Remote { return REASON_USER_REQUEST }
+		return REASON_NAS_REQUEST
+	}
+	var app_err *quic.ApplicationError
+	if errors.As(err, &app_err) {
+		if app_err.Remote { return REASON_USER_REQUEST }
+		return REASON_NAS_REQUEST
+	}
+	return REASON_LOST_CARRIER
+}
+
+// Start and stop of a session are sent in order by one goroutine, the stop
+// attributes are taken when the session ends and sent before exit
+func accounting_start(conn *Connection) {
+	if cfg.radius_server == "" { return }
+
+	conn.radius_stop = make(chan []byte, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		radius_account(conn, RADIUS_STATUS_START, get_radius_attributes(conn, RADIUS_STATUS_START))
+		radius_account(conn, RADIUS_STATUS_STOP, <-conn.radius_stop)
+	}()
+}
+
+func accounting_stop(conn *Connection) {
+	if conn.user == "" || conn.is_local() { return }
+
+	if accounting.file != nil {
+		record := accountingRecord{
+			SessionId: conn.session_id(),
+			User: conn.user,
+			Auth: conn.auth,
+			Subject: conn.subject,
+			Groups: conn.groups,
+			Remote: conn.remote,
+			Addresses: conn.prefixes,
+			Start: conn.time,
+			Stop: time.Now(),
+			RxBytes: int(conn.rx_bytes.Load()),
+			TxBytes: int(conn.tx_bytes.Load()),
+			RxPackets: int(conn.rx_packets.Load()),
+			TxPackets: int(conn.tx_packets.Load()),
+			Reason: conn.get_reason(),
+		}
+		line, err := json.Marshal(record)
+		if err != nil { panic(err) }
+
+		accounting.lock.Lock()
+		_, err = accounting.file.Write(append(line, '\n'))
+		accounting.lock.Unlock()
+		if err != nil {
+			conn.log().err("Failed to write accounting record: %s", err.Error())
+		}
+	}
+
+	if conn.radius_stop != nil {
+		conn.radius_stop <- get_radius_attributes(conn, RADIUS_STATUS_STOP)
+	}
+}
+
+func radius_attr(b []byte, typ uint8, value []byte) []byte {
+	if len(value) > 253 { value = value[:253] }
+	b = append(b, typ, uint8(len(value) + 2))
+	return append(b, value...)
+}
+
+func radius_attr_int(b []byte, typ uint8, value uint32) []byte {
+	return radius_attr(b, typ, binary.BigEndian.AppendUint32(nil, value))
+}
+
+func get_radius_attributes(conn *Connection, status uint32) []byte {
+	b := make([]byte, 0)
+	b = radius_attr(b, RADIUS_USER_NAME, []byte(conn.user))
+	b = radius_attr(b, RADIUS_NAS_IDENTIFIER, []byte(BUILD_NAME))
+	b = radius_attr(b, RADIUS_CALLING_STATION_ID, []byte(conn.remote))
+	b = radius_attr(b, RADIUS_ACCT_SESSION_ID, []byte(conn.session_id()))
+	b = radius_attr_int(b, RADIUS_ACCT_STATUS_TYPE, status)
+	b = radius_attr_int(b, RADIUS_ACCT_AUTHENTIC, RADIUS_AUTHENTIC_LOCAL)
+	b = radius_attr_int(b, RADIUS_EVENT_TIMESTAMP, uint32(time.Now().Unix()))
+
+	for _, prefix := range conn.prefixes {
+		if prefix.Addr().Is4() {
+			b = radius_attr(b, RADIUS_FRAMED_IP_ADDRESS, prefix.Addr().AsSlice())
+			continue
+		}
+		// RFC 6911 for single addresses, RFC 3162 for delegated prefixes
+		if prefix.IsSingleIP() {
+			b = radius_attr(b, RADIUS_FRAMED_IPV6_ADDRESS, prefix.Addr().AsSlice())
+			continue
+		}
+		value := append([]byte{ 0, uint8(prefix.Bits()) }, prefix.Addr().AsSlice()...)
+		b = radius_attr(b, RADIUS_FRAMED_IPV6_PREFIX, value)
+	}
+
+	if status == RADIUS_STATUS_STOP {
+		rx := uint64(conn.rx_bytes.Load())
+		tx := uint64(conn.tx_bytes.Load())
+		b = radius_attr_int(b, RADIUS_ACCT_INPUT_OCTETS, uint32(rx))
+		b = radius_attr_int(b, RADIUS_ACCT_INPUT_GIGAWORDS, uint32(rx >> 32))
+		b = radius_attr_int(b, RADIUS_ACCT_OUTPUT_OCTETS, uint32(tx))
+		b = radius_attr_int(b, RADIUS_ACCT_OUTPUT_GIGAWORDS, uint32(tx >> 32))
+		b = radius_attr_int(b, RADIUS_ACCT_INPUT_PACKETS, uint32(conn.rx_packets.Load()))
+		b = radius_attr_int(b, RADIUS_ACCT_OUTPUT_PACKETS, uint32(conn.tx_packets.Load()))
+		b = radius_attr_int(b, RADIUS_ACCT_SESSION_TIME, uint32(time.Since(conn.time).Seconds()))
+		cause, ok := TERMINATE_CAUSES[conn.get_reason()]
+		if ok {
+			b = radius_attr_int(b, RADIUS_ACCT_TERMINATE_CAUSE, cause)
+		}
+	}
+	return b
+}
+
+// Authenticator is MD5 over the packet with given request authenticator and the secret
+func get_radius_authenticator(pkt []byte, request []byte) []byte {
+	h := md5.New()
+	h.Write(pkt[:4])
+	h.Write(request)
+	h.Write(pkt[20:])
+	h.Write([]byte(cfg.radius_secret))
+	return h.Sum(nil)
+}
+
+func radius_account(conn *Connection, status uint32, attrs []byte) {
+	accounting.lock.Lock()
+	accounting.radius_id++
+	id := accounting.radius_id
+	accounting.lock.Unlock()
+
+	pkt := []byte{ RADIUS_ACCOUNTING_REQUEST, id, 0, 0 }
+	binary.BigEndian.PutUint16(pkt[2:], uint16(20 + len(attrs)))
+	pkt = append(pkt, make([]byte, 16)...)
+	pkt = append(pkt, attrs...)
+	copy(pkt[4:20], get_radius_authenticator(pkt, make([]byte, 16)))
+
+	err := radius_send(pkt)
+	if err != nil {
+		conn.log().err("RADIUS accounting to %s failed: %s", cfg.radius_server, err.Error())
+		return
+	}
+	conn.log().debug("RADIUS accounting status %d sent for session %s", status, conn.session_id())
+}
+
+// Responses that do not match the request are dropped until the timeout, a
+// spoofed or corrupted answer must not hide the valid one
+func radius_send(pkt []byte) error {
+	udp, err := net.Dial("udp", cfg.radius_server)
+	if err != nil { return err }
+	defer udp.Close()
+
+	buf := make([]byte, 4096)
+	invalid := false
+	for i := 0; i < RADIUS_RETRIES; i++ {
+		_, err = udp.Write(pkt)
+		if err != nil { return err }
+
+		udp.SetReadDeadline(time.Now().Add(radius_timeout))
+		for {
+			var n int
+			n, err = udp.Read(buf)
+			if err != nil { break }
+			rsp := buf[:n]
+			if n < 20 || rsp[0] != RADIUS_ACCOUNTING_RESPONSE || rsp[1] != pkt[1] { continue }
+			length := int(binary.BigEndian.Uint16(rsp[2:]))
+			if length < 20 || length > n { continue }
+			rsp = rsp[:length]
+			if !bytes.Equal(rsp[4:20], get_radius_authenticator(rsp, pkt[4:20])) {
+				invalid = true
+				continue
+			}
+			return nil
+		}
+	}
+	if invalid { return errors.New("Invalid response authenticator") }
+	return err
+}
+
+// Start RADIUS identifiers at a random value
+func init() {
+	seed := make([]byte, 1)
+	rand.Read(seed)
+	accounting.radius_id = seed[0]
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestDisconnectReason(t *testing.T) {
+	tests := []struct {
+		err error
+		reason string
+	}{
+		{ io.EOF, REASON_USER_REQUEST },
+		{ fmt.Errorf("read: %w", io.EOF), REASON_USER_REQUEST },
+		{ &quic.StreamError{ Remote: true }, REASON_USER_REQUEST },
+		{ &quic.StreamError{ Remote: false }, REASON_NAS_REQUEST },
+		{ &quic.ApplicationError{ Remote: true }, REASON_USER_REQUEST },
+		{ &quic.ApplicationError{ Remote: false }, REASON_NAS_REQUEST },
+		{ &quic.IdleTimeoutError{}, REASON_LOST_CARRIER },
+		{ errors.New("the corresponding stream is closed"), REASON_LOST_CARRIER },
+	}
+	for _, test := range tests {
+		reason := get_disconnect_reason(test.err)
+		if reason != test.reason {
+			t.Errorf("get_disconnect_reason(%v) = %s, want %s", test.err, reason, test.reason)
+		}
+	}
+}
+
+func get_radius_attribute(attrs []byte, typ uint8) ([]byte, bool) {
+	for len(attrs) >= 2 {
+		length := int(attrs[1])
+		if length < 2 || length > len(attrs) { break }
+		if attrs[0] == typ { return attrs[2:length], true }
+		attrs = attrs[length:]
+	}
+	return nil, false
+}
+
+// Answer accounting requests with secret and report their attributes, a forged
+// response with a bad authenticator is sent first if requested
+func radius_responder(t *testing.T, secret string, delay time.Duration, forged bool) (string, chan []byte) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { udp.Close() })
+
+	requests := make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil { return }
+			pkt := append([]byte{}, buf[:n]...)
+
+			h := md5.New()
+			h.Write(pkt[:4])
+			h.Write(make([]byte, 16))
+			h.Write(pkt[20:])
+			h.Write([]byte(secret))
+			// requests with another secret are answered, but reported without attributes
+			if bytes.Equal(pkt[4:20], h.Sum(nil)) {
+				requests <- pkt[20:]
+			} else {
+				requests <- nil
+			}
+			time.Sleep(delay)
+
+			rsp := []byte{ RADIUS_ACCOUNTING_RESPONSE, pkt[1], 0, 20 }
+			if forged {
+				udp.WriteTo(append(rsp, make([]byte, 16)...), addr)
+			}
+			h = md5.New()
+			h.Write(rsp)
+			h.Write(pkt[4:20])
+			h.Write([]byte(secret))
+			udp.WriteTo(append(rsp, h.Sum(nil)...), addr)
+		}
+	}()
+	return udp.LocalAddr().String(), requests
+}
+
+func set_radius_config(t *testing.T, server string, secret string) {
+	old_server, old_secret := cfg.radius_server, cfg.radius_secret
+	cfg.radius_server, cfg.radius_secret = server, secret
+	t.Cleanup(func() { cfg.radius_server, cfg.radius_secret = old_server, old_secret })
+}
+
+func TestRadiusAccounting(t *testing.T) {
+	server, requests := radius_responder(t, "secret", 100 * time.Millisecond, false)
+	set_radius_config(t, server, "secret")
+
+	conn := &Connection{
+		id: 1,
+		user: "user1",
+		remote: "192.0.2.1:443",
+		time: time.Now(),
+		prefixes: []netip.Prefix{ netip.MustParsePrefix("10.0.0.2/32") },
+	}
+	// stop is queued while the start is still waiting for its response
+	accounting_start(conn)
+	conn.rx_bytes.Store(5 << 32 + 7)
+	conn.set_reason(REASON_USER_REQUEST)
+	accounting_stop(conn)
+	defer wg.Wait()
+
+	for _, status := range []uint32{ RADIUS_STATUS_START, RADIUS_STATUS_STOP } {
+		var attrs[] byte
+		select {
+		case attrs = <-requests:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No accounting request with status %d", status)
+		}
+		if attrs == nil { t.Fatal("Invalid request authenticator") }
+		value, ok := get_radius_attribute(attrs, RADIUS_ACCT_STATUS_TYPE)
+		if !ok || binary.BigEndian.Uint32(value) != status {
+			t.Fatalf("Got status %v, want %d", value, status)
+		}
+		value, ok = get_radius_attribute(attrs, RADIUS_USER_NAME)
+		if !ok || string(value) != "user1" {
+			t.Errorf("Got user name %q", value)
+		}
+		if status != RADIUS_STATUS_STOP { continue }
+
+		value, ok = get_radius_attribute(attrs, RADIUS_ACCT_TERMINATE_CAUSE)
+		if !ok || binary.BigEndian.Uint32(value) != TERMINATE_CAUSES[REASON_USER_REQUEST] {
+			t.Errorf("Got terminate cause %v", value)
+		}
+		octets, _ := get_radius_attribute(attrs, RADIUS_ACCT_INPUT_OCTETS)
+		gigawords, _ := get_radius_attribute(attrs, RADIUS_ACCT_INPUT_GIGAWORDS)
+		if binary.BigEndian.Uint32(octets) != 7 || binary.BigEndian.Uint32(gigawords) != 5 {
+			t.Errorf("Got input octets %v gigawords %v", octets, gigawords)
+		}
+	}
+}
+
+func TestRadiusFramedAddresses(t *testing.T) {
+	conn := &Connection{
+		prefixes: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.2/32"),
+			netip.MustParsePrefix("2001:db8::2/128"),
+			netip.MustParsePrefix("2001:db8:0:100::/56"),
+		},
+	}
+	attrs := get_radius_attributes(conn, RADIUS_STATUS_START)
+
+	tests := []struct {
+		typ uint8
+		value[] byte
+	}{
+		{ RADIUS_FRAMED_IP_ADDRESS, netip.MustParseAddr("10.0.0.2").AsSlice() },
+		{ RADIUS_FRAMED_IPV6_ADDRESS, netip.MustParseAddr("2001:db8::2").AsSlice() },
+		{ RADIUS_FRAMED_IPV6_PREFIX, append([]byte{ 0, 56 }, netip.MustParseAddr("2001:db8:0:100::").AsSlice()...) },
+	}
+	for _, test := range tests {
+		value, ok := get_radius_attribute(attrs, test.typ)
+		if !ok || !bytes.Equal(value, test.value) {
+			t.Errorf("Attribute %d is %v, want %v", test.typ, value, test.value)
+		}
+	}
+}
+
+func test_radius_request(id uint8) []byte {
+	pkt := []byte{ RADIUS_ACCOUNTING_REQUEST, id, 0, 20 }
+	pkt = append(pkt, make([]byte, 16)...)
+	copy(pkt[4:20], get_radius_authenticator(pkt, make([]byte, 16)))
+	return pkt
+}
+
+func use_radius_timeout(t *testing.T, timeout time.Duration) {
+	old := radius_timeout
+	radius_timeout = timeout
+	t.Cleanup(func() { radius_timeout = old })
+}
+
+func TestRadiusWrongSecret(t *testing.T) {
+	use_radius_timeout(t, 200 * time.Millisecond)
+	server, requests := radius_responder(t, "other", 0, false)
+	set_radius_config(t, server, "secret")
+
+	// invalid responses are dropped and the request is sent again
+	err := radius_send(test_radius_request(1))
+	if err == nil || err.Error() != "Invalid response authenticator" {
+		t.Fatalf("Response with wrong secret gave %v", err)
+	}
+	if len(requests) != RADIUS_RETRIES {
+		t.Errorf("Sent %d requests, want %d", len(requests), RADIUS_RETRIES)
+	}
+}
+
+func TestRadiusForgedResponse(t *testing.T) {
+	use_radius_timeout(t, 200 * time.Millisecond)
+	server, requests := radius_responder(t, "secret", 0, true)
+	set_radius_config(t, server, "secret")
+
+	// the valid response following the forged one is accepted without retry
+	err := radius_send(test_radius_request(2))
+	if err != nil { t.Fatalf("Valid response after forged one rejected: %s", err) }
+	if len(requests) != 1 {
+		t.Errorf("Sent %d requests, want 1", len(requests))
+	}
+}
@@ -0,0 +1,85 @@
+//go:build server
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var acme_manager *autocert.Manager
+
+func acme_enabled() bool {
+	return cfg.acme != ""
+}
+
+// Certificates are obtained on first use and renewed in the background
+func acme_init() {
+	if !acme_enabled() { return }
+
+	hosts := strings.Fields(cfg.acme)
+	client := &acme.Client{ DirectoryURL: cfg.acme_directory }
+	if cfg.acme_ca != "" {
+		ca_pool, err := load_ca_pool(cfg.acme_ca)
+		if err != nil { log_fatal("%s", err.Error()) }
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{ RootCAs: ca_pool }
+		client.HTTPClient = &http.Client{ Transport: transport }
+	}
+
+	acme_manager = &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache: autocert.DirCache(cfg.acme_cache),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email: cfg.acme_email,
+		Client: client,
+	}
+
+	listen := cfg.acme_listen
+	if listen == "" && cfg.acme_challenge == "http-01" {
+		listen = ":80"
+	} else if listen == "" {
+		listen = ":443"
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil { log_fatal("Cant listen for ACME challenges on %s: %s", listen, err.Error()) }
+	log_info("Answering ACME %s challenges on %s", cfg.acme_challenge, listen)
+
+	go func() {
+		var err error
+		if cfg.acme_challenge == "http-01" {
+			err = http.Serve(l, acme_manager.HTTPHandler(nil))
+		} else {
+			err = http.Serve(tls.NewListener(l, acme_manager.TLSConfig()), http.NotFoundHandler())
+		}
+		log_err("ACME challenge listener failed: %s", err.Error())
+	}()
+
+	// fetch certificates now instead of in the first handshake
+	for _, host := range hosts {
+		go func(host string) {
+			_, err := acme_manager.GetCertificate(&tls.ClientHelloInfo{ ServerName: host })
+			if err != nil {
+				log_err("Failed to obtain certificate for %s: %s", host, err.Error())
+				return
+			}
+			log_info("Certificate for %s ready", host)
+		}(host)
+	}
+}
+
+// Clients without SNI get the certificate of the first host
+func acme_get_certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if acme_manager == nil { return nil, errors.New("ACME not initialized") }
+	if hello.ServerName == "" {
+		h := *hello
+		h.ServerName = strings.Fields(cfg.acme)[0]
+		hello = &h
+	}
+	return acme_manager.GetCertificate(hello)
+}
@@ -0,0 +1,290 @@
+//go:build server
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Runtime state changed through the admin socket, kept in memory only and lost on restart
+var admin struct {
+	draining atomic.Bool
+	disabled map[string]bool
+	lock sync.Mutex
+}
+
+type sessionInfo struct {
+	Id int `json:"id"`
+	User string `json:"user"`
+	Host string `json:"host,omitempty"`
+	Addresses[] netip.Prefix `json:"addresses"`
+	Remote string `json:"remote"`
+	Time time.Time `json:"time"`
+	LastRx time.Time `json:"last_rx"`
+	RxBytes int `json:"rx_bytes"`
+	TxBytes int `json:"tx_bytes"`
+	Routes[] netip.Prefix `json:"routes"`
+}
+
+func user_disabled(user string) bool {
+	admin.lock.Lock()
+	defer admin.lock.Unlock()
+	return admin.disabled[user]
+}
+
+func get_sessions() []sessionInfo {
+	var sessions[] sessionInfo
+
+	connection_sync.RLock()
+	for _, conn := range connections {
+		if conn.user == "" { continue }
+		sessions = append(sessions, sessionInfo{
+			Id: conn.id,
+			User: conn.user,
+			Host: conn.host_name(),
+			Addresses: conn.prefixes,
+			Remote: conn.remote,
+			Time: conn.time,
+			LastRx: conn.get_last_rx(),
+			RxBytes: int(conn.rx_bytes.Load()),
+			TxBytes: int(conn.tx_bytes.Load()),
+			Routes: conn.announced,
+		})
+	}
+	connection_sync.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Id < sessions[j].Id })
+	return sessions
+}
+
+// Close sessions matching the filter, returns number of closed sessions
+func kick_sessions(match func(*Connection) bool, reason string) int {
+	var kick[] *Connection
+
+	connection_sync.RLock()
+	for _, conn := range connections {
+		if conn.user == "" || conn.close == nil || !match(conn) { continue }
+		kick = append(kick, conn)
+	}
+	connection_sync.RUnlock()
+
+	for _, conn := range kick {
+		conn.log().info("Disconnecting session %d of user %s", conn.id, conn.user)
+		conn.set_reason(reason)
+		conn.close()
+	}
+	return len(kick)
+}
+
+// Stop accepting sessions and exit once the last one is gone
+func drain_server() {
+	if admin.draining.Swap(true) { return }
+	log_info("Draining server, rejecting new sessions")
+
+	go func() {
+		for {
+			if len(get_sessions()) == 0 { break }
+			time.Sleep(1 * time.Second)
+		}
+		log_info("Server drained")
+		cfg.done <- syscall.SIGTERM
+	}()
+}
+
+func admin_reply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func admin_handler() http.Handler {
+	handler := http.NewServeMux()
+
+	handler.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		admin_reply(w, get_sessions())
+	})
+
+	handler.HandleFunc("/kick", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "Invalid session id", http.StatusBadRequest)
+			return
+		}
+		count := kick_sessions(func(conn *Connection) bool { return conn.id == id }, REASON_ADMIN_RESET)
+		if count == 0 {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		admin_reply(w, map[string]int{ "disconnected": count })
+	})
+
+	handler.HandleFunc("/disable", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		user := r.URL.Query().Get("user")
+		if user == "" {
+			http.Error(w, "Missing user", http.StatusBadRequest)
+			return
+		}
+		admin.lock.Lock()
+		admin.disabled[user] = true
+		admin.lock.Unlock()
+		log_info("User %s disabled", user)
+
+		count := kick_sessions(func(conn *Connection) bool { return conn.user == user }, REASON_ADMIN_RESET)
+		admin_reply(w, map[string]int{ "disconnected": count })
+	})
+
+	handler.HandleFunc("/enable", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		user := r.URL.Query().Get("user")
+		admin.lock.Lock()
+		delete(admin.disabled, user)
+		admin.lock.Unlock()
+		log_info("User %s enabled", user)
+		admin_reply(w, map[string]string{ "user": user })
+	})
+
+	handler.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		drain_server()
+		admin_reply(w, map[string]int{ "sessions": len(get_sessions()) })
+	})
+
+	return handler
+}
+
+// Serve the admin API on a unix socket only reachable by local users
+func admin_init(socket string) {
+	admin.disabled = make(map[string]bool)
+	if socket == "" { return }
+
+	// only remove a stale socket, never take over the one of a running instance
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err == nil {
+		conn.Close()
+		log_fatal("Admin socket %s is in use by another instance", socket)
+	}
+	info, err := os.Lstat(socket)
+	if err == nil && info.Mode() & os.ModeSocket != 0 {
+		os.Remove(socket)
+	}
+
+	// create the socket accessible by the owner only, there is no window with wider permissions
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", socket)
+	syscall.Umask(umask)
+	if err != nil { log_fatal("Cant listen on admin socket %s: %s", socket, err.Error()) }
+
+	server := &http.Server{ Handler: admin_handler() }
+	go server.Serve(listener)
+	log_info("Admin API listening on %s", socket)
+}
+
+func admin_request(socket string, method string, path string) ([]byte, error) {
+	client := http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	req, err := http.NewRequest(method, "http://admin"+path, nil)
+	if err != nil { return nil, err }
+	rsp, err := client.Do(req)
+	if err != nil { return nil, err }
+	defer rsp.Body.Close()
+
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil { return nil, err }
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.New(string(body))
+	}
+	return body, nil
+}
+
+func print_sessions(body []byte) error {
+	var sessions[] sessionInfo
+	err := json.Unmarshal(body, &sessions)
+	if err != nil { return err }
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tHOST\tADDRESSES\tREMOTE\tCONNECTED\tRX\tTX\tROUTES")
+	for _, s := range sessions {
+		host := s.Host
+		if host == "" { host = "-" }
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%v\t%s\t%s\t%s\t%s\t%v\n", s.Id, s.User, host, s.Addresses, s.Remote,
+			s.Time.Format(time.RFC3339), get_byte_unit(s.RxBytes, 0), get_byte_unit(s.TxBytes, 0), s.Routes)
+	}
+	return tw.Flush()
+}
+
+// h3tunnel ctl [-socket path] [-json] list|kick ID|disable USER|enable USER|drain
+func run_ctl(args []string) {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := flags.String("socket", ADMIN_SOCKET, "Admin socket of the server")
+	raw := flags.Bool("json", false, "Print JSON output")
+	flags.Parse(args)
+	args = flags.Args()
+
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: h3tunnel ctl [-socket path] [-json] list|kick ID|disable USER|enable USER|drain")
+		os.Exit(2)
+	}
+	if len(args) == 0 { usage() }
+
+	var body []byte
+	var err error
+	switch args[0] {
+	case "list":
+		body, err = admin_request(*socket, http.MethodGet, "/sessions")
+		if err == nil && !*raw {
+			err = print_sessions(body)
+			body = nil
+		}
+	case "kick", "disable", "enable":
+		if len(args) != 2 { usage() }
+		key := "user"
+		if args[0] == "kick" { key = "id" }
+		body, err = admin_request(*socket, http.MethodPost, "/"+args[0]+"?"+key+"="+url.QueryEscape(args[1]))
+	case "drain":
+		body, err = admin_request(*socket, http.MethodPost, "/drain")
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %s\n", args[0], err.Error())
+		os.Exit(1)
+	}
+	os.Stdout.Write(body)
+}
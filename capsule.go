@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net/netip"
+	"slices"
 
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/quic-go/quicvarint"
@@ -18,10 +20,18 @@ const (
 	ROUTE_ADVERTISEMENT =	0x03
 )
 
+// RFC 9484 context ID for datagrams carrying a full IP packet
+const CONTEXT_ID_IP = 0
+
+type capsule_entry struct {
+	reqid int
+	address netip.Prefix
+	protocol uint8
+}
+
 type capsule struct {
 	typ http3.CapsuleType
-	address netip.Prefix
-	protocol int
+	entries[] capsule_entry
 }
 
 /*
@@ -51,7 +61,7 @@ func read_bytes(r io.Reader, buf []byte) error {
 	want := len(buf)
 	n, err := io.ReadFull(r, buf)
 	if err != nil { return err }
-	if n != want { errors.New("Invalid size read") }
+	if n != want { return errors.New("Invalid size read") }
 	return nil
 }
 
@@ -152,36 +162,41 @@ func parse_ip_capsule(r quicvarint.Reader) (*capsule, error) {
 	if err != nil { return nil, err }
 
 	val, err := io.ReadAll(ior)
+	if err != nil { return nil, err }
 	log_debug("Parsing HTTP capsule with type %d and len %d", capsule_type, len(val))
-	r = bytes.NewReader(val)
+	br := bytes.NewReader(val)
 
 	switch capsule_type {
 	case DATAGRAM:
 		// nothing to do
-	case ADDRESS_ASSIGN:
-		reqid, err := quicvarint.Read(quicvarint.NewReader(r))
-		if err != nil { return nil, err }
-		addr, err := parse_address(r)
-		if err != nil { return nil, err }
-		log_debug("IP capsule: Assign %d %s", reqid, addr.String())
-		return &capsule{ typ: capsule_type, address: addr }, nil
-	case ADDRESS_REQUEST:
-		reqid, err := quicvarint.Read(quicvarint.NewReader(r))
-		if err != nil { return nil, err }
-		addr, err := parse_address(r)
-		if err != nil { return nil, err }
-		log_debug("IP capsule: Request %d %s", reqid, addr.String())
-		return &capsule{ typ: capsule_type, address: addr }, nil
-	case ROUTE_ADVERTISEMENT:
-		prefix, proto, err := parse_address_range(r)
-		if err != nil { return nil, err }
-		log_debug("IP capsule: Route %s %d", prefix.String(), proto)
-		return &capsule{ typ: capsule_type, address: prefix }, nil
+		return nil, nil
+	case ADDRESS_ASSIGN, ADDRESS_REQUEST, ROUTE_ADVERTISEMENT:
 	default:
 		log_warn("Unsupported capsule type receeived: %d", capsule_type)
+		return nil, nil
 	}
 
-	return nil, nil
+	c := &capsule{ typ: capsule_type }
+	for br.Len() > 0 {
+		var entry capsule_entry
+
+		switch capsule_type {
+		case ADDRESS_ASSIGN, ADDRESS_REQUEST:
+			reqid, err := quicvarint.Read(br)
+			if err != nil { return nil, err }
+			entry.reqid = int(reqid)
+			entry.address, err = parse_address(br)
+			if err != nil { return nil, err }
+			log_debug("IP capsule: Address %d %s", entry.reqid, entry.address.String())
+		case ROUTE_ADVERTISEMENT:
+			entry.address, entry.protocol, err = parse_address_range(br)
+			if err != nil { return nil, err }
+			log_debug("IP capsule: Route %s %d", entry.address.String(), entry.protocol)
+		}
+		c.entries = append(c.entries, entry)
+	}
+
+	return c, nil
 }
 
 func get_family(addr netip.Addr) (uint8, uint8) {
@@ -193,38 +208,96 @@ func get_family(addr netip.Addr) (uint8, uint8) {
 	panic("Invalid IP address")
 }
 
-func AssignAddress(w quicvarint.Writer, reqid int, addr netip.Addr) error {
-	family, length := get_family(addr)
+func append_address(b []byte, entry capsule_entry) []byte {
+	family, _ := get_family(entry.address.Addr())
 
-	b := quicvarint.Append(nil, uint64(reqid))
+	b = quicvarint.Append(b, uint64(entry.reqid))
 	b = append(b, family)
-	b = append(b, addr.AsSlice()...)
-	b = append(b, length)
+	b = append(b, entry.address.Addr().AsSlice()...)
+	b = append(b, uint8(entry.address.Bits()))
+	return b
+}
+
+func AssignAddress(w quicvarint.Writer, entries []capsule_entry) error {
+	b := make([]byte, 0)
+	for _, entry := range entries {
+		b = append_address(b, entry)
+	}
 
 	return http3.WriteCapsule(w, ADDRESS_ASSIGN, b)
 }
 
-func RequestAddress(w quicvarint.Writer, reqid int, addr netip.Addr) error {
-	family, length := get_family(addr)
-	if reqid == 0 { panic("RequestAddress ID must not be zero") }
-
-	b := quicvarint.Append(nil, uint64(reqid))
-	b = append(b, family)
-	b = append(b, addr.AsSlice()...)
-	b = append(b, length)
+func RequestAddress(w quicvarint.Writer, entries []capsule_entry) error {
+	b := make([]byte, 0)
+	for _, entry := range entries {
+		if entry.reqid == 0 { panic("RequestAddress ID must not be zero") }
+		b = append_address(b, entry)
+	}
 
 	return http3.WriteCapsule(w, ADDRESS_REQUEST, b)
 }
 
-func AddressRange(w quicvarint.Writer, prefix netip.Prefix) error {
-	first, last := extnetip.Range(prefix)
-	family, _ := get_family(first)
+// All ranges in one capsule, sorted with IPv4 before IPv6
+func AddressRange(w quicvarint.Writer, prefixes []netip.Prefix, proto uint8) error {
+	prefixes = slices.Clone(prefixes)
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		return a.Masked().Addr().Compare(b.Masked().Addr())
+	})
 
 	b := make([]byte, 0)
-	b = append(b, family)
-	b = append(b, first.AsSlice()...)
-	b = append(b, last.AsSlice()...)
-	b = append(b, uint8(0))
+	for _, prefix := range prefixes {
+		first, last := extnetip.Range(prefix)
+		family, _ := get_family(first)
+
+		b = append(b, family)
+		b = append(b, first.AsSlice()...)
+		b = append(b, last.AsSlice()...)
+		b = append(b, proto)
+	}
 
 	return http3.WriteCapsule(w, ROUTE_ADVERTISEMENT, b)
 }
+
+/*
+HTTP Datagram Payload {
+  Context ID (i),
+  Payload (..),
+}
+*/
+
+type ipDatagrammer struct {
+	datagrammer http3.Datagrammer
+}
+
+func new_ip_datagrammer(datagrammer http3.Datagrammer) http3.Datagrammer {
+	if cfg.legacy_datagrams {
+		return datagrammer
+	}
+	return &ipDatagrammer{ datagrammer: datagrammer }
+}
+
+func (d *ipDatagrammer) SendMessage(data []byte) error {
+	b := make([]byte, 0, len(data) + 1)
+	b = quicvarint.Append(b, CONTEXT_ID_IP)
+	b = append(b, data...)
+	return d.datagrammer.SendMessage(b)
+}
+
+func (d *ipDatagrammer) ReceiveMessage(ctx context.Context) ([]byte, error) {
+	for {
+		data, err := d.datagrammer.ReceiveMessage(ctx)
+		if err != nil { return nil, err }
+
+		r := bytes.NewReader(data)
+		id, err := quicvarint.Read(r)
+		if err != nil {
+			log_debug("Dropping datagram without context ID")
+			continue
+		}
+		if id != CONTEXT_ID_IP {
+			log_debug("Dropping datagram with unknown context ID %d", id)
+			continue
+		}
+		return data[len(data) - r.Len():], nil
+	}
+}
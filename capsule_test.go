@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+func TestCapsuleRoundTrip(t *testing.T) {
+	entries := []capsule_entry{
+		{ reqid: 1, address: netip.MustParsePrefix("10.0.0.2/32") },
+		{ reqid: 2, address: netip.MustParsePrefix("2001:db8::/64") },
+		{ reqid: 300, address: netip.MustParsePrefix("0.0.0.0/32") },
+	}
+	routes := []netip.Prefix{
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+	}
+
+	tests := []struct {
+		typ http3.CapsuleType
+		write func(*bytes.Buffer) error
+		entries[] capsule_entry
+	}{
+		{ ADDRESS_ASSIGN, func(b *bytes.Buffer) error { return AssignAddress(b, entries) }, entries },
+		{ ADDRESS_REQUEST, func(b *bytes.Buffer) error { return RequestAddress(b, entries) }, entries },
+		{ ADDRESS_ASSIGN, func(b *bytes.Buffer) error { return AssignAddress(b, nil) }, nil },
+		{ ROUTE_ADVERTISEMENT, func(b *bytes.Buffer) error { return AddressRange(b, routes, 17) }, []capsule_entry{
+			{ address: netip.MustParsePrefix("0.0.0.0/0"), protocol: 17 },
+			{ address: netip.MustParsePrefix("10.0.0.0/8"), protocol: 17 },
+			{ address: netip.MustParsePrefix("2001:db8::/32"), protocol: 17 },
+		} },
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := test.write(&buf)
+		if err != nil { t.Fatal(err) }
+
+		c, err := parse_ip_capsule(quicvarint.NewReader(&buf))
+		if err != nil {
+			t.Errorf("Capsule %d failed to parse: %s", test.typ, err.Error())
+			continue
+		}
+		if c.typ != test.typ || !slices.Equal(c.entries, test.entries) {
+			t.Errorf("Capsule %d parsed as %d %v, want %v", test.typ, c.typ, c.entries, test.entries)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Capsule %d left %d bytes", test.typ, buf.Len())
+		}
+	}
+}
+
+func TestCapsuleInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		typ http3.CapsuleType
+		data[] byte
+		ignored bool
+	}{
+		{ name: "unknown version", typ: ADDRESS_ASSIGN, data: []byte{ 1, 5, 10, 0, 0, 1, 32 } },
+		{ name: "IPv4 prefix too long", typ: ADDRESS_ASSIGN, data: []byte{ 1, 4, 10, 0, 0, 1, 33 } },
+		{ name: "truncated address", typ: ADDRESS_REQUEST, data: []byte{ 1, 6, 0x20, 0x01 } },
+		{ name: "missing prefix length", typ: ADDRESS_REQUEST, data: []byte{ 1, 4, 10, 0, 0, 1 } },
+		{ name: "range without prefix", typ: ROUTE_ADVERTISEMENT, data: []byte{ 4, 10, 0, 0, 1, 10, 0, 0, 2, 0 } },
+		{ name: "range without protocol", typ: ROUTE_ADVERTISEMENT, data: []byte{ 4, 10, 0, 0, 0, 10, 0, 0, 255 } },
+		{ name: "datagram", typ: DATAGRAM, data: []byte{ 0, 1, 2 }, ignored: true },
+		{ name: "unknown type", typ: 0x4242, data: []byte{ 1 }, ignored: true },
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := http3.WriteCapsule(&buf, test.typ, test.data)
+		if err != nil { t.Fatal(err) }
+
+		c, err := parse_ip_capsule(quicvarint.NewReader(&buf))
+		if test.ignored {
+			if c != nil || err != nil { t.Errorf("%s: got %v %v, want ignored", test.name, c, err) }
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: parsed as %v", test.name, c)
+		}
+	}
+}
+
+// Sent datagrams are written to tx and received ones read from rx,
+// closing rx ends the stream
+type chanDatagrammer struct {
+	rx chan []byte
+	tx chan []byte
+}
+
+func new_chan_datagrammer() *chanDatagrammer {
+	return &chanDatagrammer{ rx: make(chan []byte, 10), tx: make(chan []byte, 10) }
+}
+
+func (d *chanDatagrammer) SendMessage(data []byte) error {
+	d.tx <- slices.Clone(data)
+	return nil
+}
+
+func (d *chanDatagrammer) ReceiveMessage(ctx context.Context) ([]byte, error) {
+	select {
+	case data, ok := <-d.rx:
+		if !ok { return nil, io.EOF }
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestIpDatagrammer(t *testing.T) {
+	inner := new_chan_datagrammer()
+	d := &ipDatagrammer{ datagrammer: inner }
+
+	packet := []byte{ 0x45, 0, 0, 20 }
+	err := d.SendMessage(packet)
+	if err != nil { t.Fatal(err) }
+	sent := <-inner.tx
+	if !bytes.Equal(sent, append([]byte{ CONTEXT_ID_IP }, packet...)) {
+		t.Fatalf("Sent %v", sent)
+	}
+
+	// datagrams without or with another context ID are skipped
+	inner.rx <- []byte{}
+	inner.rx <- quicvarint.Append(nil, 64)
+	inner.rx <- sent
+	data, err := d.ReceiveMessage(context.Background())
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(data, packet) {
+		t.Fatalf("Received %v, want %v", data, packet)
+	}
+}
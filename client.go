@@ -3,28 +3,73 @@ package main
 
 import (
 	"bytes"
-	"strconv"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
 	"net"
 	"net/netip"
 	"net/http"
 	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
 
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/quic-go/quicvarint"
 )
 
 var BUILD_TYPE = "client"
 
+const (
+	TUNNEL_CLOSED = "closed"
+	TUNNEL_CONNECTING = "connecting"
+	TUNNEL_ESTABLISHED = "established"
+	TUNNEL_RECONNECTING = "reconnecting"
+	TUNNEL_FAILED = "failed"
+)
+
+// Tunnel state kept across reconnects
+var tunnel struct {
+	state string
+	state_lock sync.Mutex
+	dev *tunDev
+	local *Connection
+	requests[] capsule_entry
+	prefixes[] netip.Prefix
+	routes[] netip.Prefix
+	port int
+	stop chan struct{}
+}
+
+type statusError struct {
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("HTTP request failed: %d %s", e.status, http.StatusText(e.status))
+}
+
 func main() {
 	get_client_config()
 
+	var err error
+	tunnel.requests, err = parse_iprequest(cfg.iprequest)
+	if err != nil { log_fatal("Invalid iprequest: %s", err.Error()) }
+
 	if cfg.hostname == "" {
 		cfg.hostname = read_stdin("Hostname")
 	}
-	if cfg.username == "" {
+	use_token := cfg.token_file != "" || cfg.token_command != ""
+	if cfg.username == "" && !use_token {
 		cfg.username = read_stdin("Username")
 	}
-	if cfg.password == "" {
+	if cfg.password == "" && !use_token {
 		cfg.password = read_stdin("Password")
 	}
 
@@ -32,7 +77,6 @@ func main() {
 		go benchmark_server(cfg.netns)
 	}
 
-	log_info("Connecting to %s:%d", cfg.hostname, cfg.port);
 	Client(cfg.hostname, cfg.port)
 
 	log_info("Waiting for all threads to stop")
@@ -40,65 +84,378 @@ func main() {
 	log_info("Exiting")
 }
 
+func set_tunnel_state(state string) {
+	tunnel.state_lock.Lock()
+	defer tunnel.state_lock.Unlock()
+
+	if tunnel.state == state { return }
+	log_info("Tunnel state %s -> %s", tunnel.state, state)
+	tunnel.state = state
+}
+
+// Exponential backoff with jitter in the upper half of the delay
+func get_backoff(attempt int) time.Duration {
+	max := time.Duration(cfg.reconnect_max_delay) * time.Second
+	delay := max
+	if attempt < 30 {
+		delay = time.Duration(cfg.reconnect_delay) * time.Second << (attempt - 1)
+	}
+	if delay > max || delay <= 0 {
+		delay = max
+	}
+	return delay / 2 + time.Duration(rand.Int63n(int64(delay / 2) + 1))
+}
+
+// Authentication and authorization failures are not retried
+func is_permanent(err error) bool {
+	var status *statusError
+	if !errors.As(err, &status) { return false }
+	return status.status == http.StatusUnauthorized || status.status == http.StatusForbidden
+}
+
+var errFailback = errors.New("Preferred server available again")
+
+func is_stopped() bool {
+	select {
+	case <-tunnel.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 func Client(hostname string, port int) {
-	dev := create_tun()
+	servers := parse_servers(hostname, port)
+	if len(servers) == 0 { log_fatal("No usable server in %s", hostname) }
+
+	tunnel.state = TUNNEL_CLOSED
+	tunnel.dev = create_tun(cfg.dev)
+	cfg.dev = tunnel.dev.name
+	tunnel.stop = make(chan struct{})
+	go func() {
+		<-cfg.done
+		close(tunnel.stop)
+	}()
+
+	// keep local port across reconnects for the default route rules
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil { log_fatal("Cant open UDP socket: %s", err.Error()) }
+	transport := &quic.Transport{ Conn: udp }
+	tunnel.port = udp.LocalAddr().(*net.UDPAddr).Port
+	metrics_init(cfg.metrics)
+
+	attempt := 0
+	for !is_stopped() {
+		// try each server in order, fail over on any error
+		list := get_server_list(servers)
+		permanent := len(list) > 0
+		failback := false
+		for i, server := range list {
+			set_tunnel_state(TUNNEL_CONNECTING)
+			var preferred[] serverEntry
+			if cfg.failback > 0 {
+				preferred = list[:i]
+			}
+
+			log_info("Connecting to %s", server.String())
+			established, err := run_session(transport, server, preferred)
+			if established { attempt = 0 }
+			if is_stopped() { break }
+			if errors.Is(err, errFailback) {
+				log_info("Moving back to preferred server")
+				failback = true
+				break
+			}
+
+			if err != nil {
+				log_err("Connection to %s failed: %s", server.String(), err.Error())
+			}
+			if !is_permanent(err) { permanent = false }
+			if established { break }
+		}
+		if is_stopped() { break }
+		if failback { continue }
+		if len(list) == 0 {
+			log_err("No server found for %s", hostname)
+		}
+
+		if !cfg.reconnect || permanent {
+			set_tunnel_state(TUNNEL_FAILED)
+			break
+		}
+
+		attempt++
+		if cfg.reconnect_attempts > 0 && attempt > cfg.reconnect_attempts {
+			log_err("Giving up after %d reconnect attempts", cfg.reconnect_attempts)
+			set_tunnel_state(TUNNEL_FAILED)
+			break
+		}
+
+		delay := get_backoff(attempt)
+		set_tunnel_state(TUNNEL_RECONNECTING)
+		log_info("Reconnecting in %s, attempt %d", delay.Round(time.Millisecond), attempt)
+		select {
+		case <-tunnel.stop:
+		case <-time.After(delay):
+		}
+	}
+
+	for _, route := range tunnel.routes {
+		remove_route(cfg.dev, route, tunnel.port)
+	}
+	set_tunnel_state(TUNNEL_CLOSED)
+	transport.Close()
+	tunnel.dev.Close()
+}
+
+// Cancel the session once a preferred server answers a handshake
+func probe_failback(ctx context.Context, cancel context.CancelCauseFunc, transport *quic.Transport, preferred []serverEntry) {
+	ticker := time.NewTicker(time.Duration(cfg.failback) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, server := range preferred {
+			if !probe_server(transport, server) { continue }
+			log_info("Preferred server %s is reachable", server.String())
+			cancel(errFailback)
+			return
+		}
+	}
+}
+
+// Run one connection to the server until the tunnel is closed
+func run_session(transport *quic.Transport, server serverEntry, preferred []serverEntry) (bool, error) {
+	start := time.Now()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-tunnel.stop:
+			cancel(nil)
+		case <-ctx.Done():
+		}
+	}()
 
 	rt := &http3.RoundTripper{
 		QuicConfig: quic_cfg,
 		EnableDatagrams: true,
-		TLSClientConfig: generateTLSConfig(true),
+		TLSClientConfig: generateTLSConfig(),
+		Dial: func(ctx context.Context, addr string, tls_cfg *tls.Config, quic_cfg *quic.Config) (quic.EarlyConnection, error) {
+			return dial_happy_eyeballs(ctx, transport, addr, tls_cfg, quic_cfg)
+		},
 	}
+	defer rt.Close()
+
+	path := expand_uri_template(cfg.uri_template, map[string]string{
+		"target": cfg.target,
+		"ipproto": cfg.ipproto,
+	})
+	uri, err := url.Parse("https://" + server.String() + path)
+	if err != nil { log_fatal("Invalid URI template %s: %s", cfg.uri_template, err.Error()) }
 
 	reqHdr := http.Header{}
 	reqHdr.Set("capsule-protocol", "?1")
 	req := http.Request{
 		Method: http.MethodConnect,
 		Header: reqHdr,
-		Proto: "connect-ip",
-		URL: &url.URL{
-			Host: net.JoinHostPort(hostname, strconv.Itoa(port)),
-			Scheme: "https",
-			Path: MASQUE_PATH,
-		},
+		// sent as :protocol pseudo-header of the extended CONNECT
+		Proto: CONNECT_IP_PROTOCOL,
+		URL: uri,
 	}
 
-	req.SetBasicAuth(cfg.username, cfg.password)
-
-	client := &http.Client{
-		Transport: rt,
+	token, err := get_token()
+	if err != nil { return false, err }
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		req.SetBasicAuth(cfg.username, cfg.password)
 	}
 
-	datagrammer, respChan, err := client.Transport.(*http3.RoundTripper).RoundTripWithDatagrams(&req, http3.RoundTripOpt{DontCloseRequestStream: true})
-	if err != nil { log_fatal("Cant connect: %s", err.Error()) }
+	datagrammer, respChan, err := rt.RoundTripWithDatagrams(req.WithContext(ctx), http3.RoundTripOpt{DontCloseRequestStream: true})
+	if err != nil { return false, err }
 	rsp := <-respChan
-	if rsp.Err != nil { log_fatal("Failed to connect: %s", rsp.Err.Error()) }
+	if rsp.Err != nil { return false, rsp.Err }
 
 	dump_response(rsp.Resp)
-	if rsp.Resp.StatusCode != http.StatusOK {
-		log_err("Failed HTTP request: %d %s", rsp.Resp.StatusCode, http.StatusText(rsp.Resp.StatusCode))
-		return
+	if rsp.Resp.StatusCode < 200 || rsp.Resp.StatusCode > 299 {
+		return false, &statusError{ status: rsp.Resp.StatusCode }
 	}
+	if rsp.Resp.Header.Get("capsule-protocol") != "?1" {
+		return false, errors.New("Server does not support the capsule protocol")
+	}
+	stats.handshake.observe(time.Since(start))
 
 	str := rsp.Resp.Body.(http3.HTTPStreamer).HTTPStream()
-	qconn := rsp.Resp.Body.(http3.Hijacker).StreamCreator()
+	tunnel_done := make(chan *Connection, 1)
 
 	wg.Add(1)
-	go setup_tunnel(str, dev, datagrammer, qconn.LocalAddr().(*net.UDPAddr).Port)
+	go func() {
+		tunnel_done <- setup_tunnel(str, new_ip_datagrammer(datagrammer))
+	}()
 
-	<-cfg.done
+	if len(preferred) > 0 {
+		go probe_failback(ctx, cancel, transport, preferred)
+	}
+
+	var conn *Connection
+	select {
+	case conn = <-tunnel_done:
+	case <-ctx.Done():
+		rt.Close()
+		conn = <-tunnel_done
+	}
+
+	// wait for the remote connection to leave the forwarding table
 	rt.Close()
-	dev.Close()
+	if conn != nil {
+		<-conn.done
+		if errors.Is(context.Cause(ctx), errFailback) { return true, errFailback }
+		return true, errors.New("Tunnel closed")
+	}
+	return false, errors.New("Tunnel closed before address assignment")
+}
+
+// Bearer token from a helper command or file, read again for every session
+func get_token() (string, error) {
+	var data []byte
+	var err error
+	if cfg.token_command != "" {
+		cmd := exec.Command("/bin/sh", "-c", cfg.token_command)
+		cmd.Stderr = os.Stderr
+		data, err = cmd.Output()
+		if err != nil { return "", fmt.Errorf("Token command failed: %s", err.Error()) }
+	} else if cfg.token_file != "" {
+		data, err = os.ReadFile(cfg.token_file)
+		if err != nil { return "", err }
+	} else {
+		return "", nil
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" { return "", errors.New("Empty bearer token") }
+	return token, nil
+}
+
+func parse_iprequest(iprequest string) ([]capsule_entry, error) {
+	var requests[] capsule_entry
+	for i, field := range strings.Fields(iprequest) {
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			addr, err := netip.ParseAddr(field)
+			if err != nil { return nil, err }
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		requests = append(requests, capsule_entry{ reqid: i + 1, address: prefix })
+	}
+	if len(requests) == 0 { return nil, errors.New("No address requested") }
+	return requests, nil
+}
+
+// Ask for the previous addresses again after a reconnect
+func get_address_requests() []capsule_entry {
+	if len(tunnel.prefixes) == 0 {
+		return tunnel.requests
+	}
+
+	var requests[] capsule_entry
+	for i, prefix := range tunnel.prefixes {
+		requests = append(requests, capsule_entry{ reqid: i + 1, address: prefix })
+	}
+	log_info("Requesting previous addresses again")
+	return requests
+}
+
+// Use first address of a delegated prefix on the tun device
+func get_local_address(prefix netip.Prefix) netip.Prefix {
+	if prefix.IsSingleIP() { return prefix }
+	log_info("Received delegated prefix %s", prefix.String())
+	addr := prefix.Masked().Addr().Next()
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// Configure assigned addresses, keeping the ones of the previous session
+func update_addresses(entries []capsule_entry, requests []capsule_entry) error {
+	var prefixes[] netip.Prefix
+	for _, entry := range entries {
+		if entry.reqid > len(requests) {
+			log_warn("Ignoring address assignment for unknown request %d", entry.reqid)
+			continue
+		}
+		if !slices.Contains(tunnel.prefixes, entry.address) {
+			err := setup_ip(cfg.dev, get_local_address(entry.address))
+			if err != nil {
+				log_err("Failed to configure address %s: %s", entry.address.String(), err.Error())
+				continue
+			}
+		}
+		prefixes = append(prefixes, entry.address)
+	}
+	if len(prefixes) == 0 {
+		return errors.New("No usable address assigned")
+	}
+
+	for _, prefix := range tunnel.prefixes {
+		if slices.Contains(prefixes, prefix) { continue }
+		err := remove_ip(cfg.dev, get_local_address(prefix))
+		if err != nil {
+			log_err("Failed to remove address %s: %s", prefix.String(), err.Error())
+		}
+	}
+
+	local := append(slices.Clone(prefixes), parse_prefixes(cfg.advertise)...)
+	if tunnel.local == nil {
+		conn := NewConnection(tunnel.dev, local, "", nil, nil)
+		err := AddConnection(conn)
+		if err != nil { return err }
+		tunnel.local = conn
+	} else {
+		err := tunnel.local.update_prefixes(local)
+		if err != nil { return err }
+	}
+	tunnel.prefixes = prefixes
+	return nil
+}
+
+// Each advertisement carries the full route set
+func update_routes(entries []capsule_entry) {
+	var routes[] netip.Prefix
+	for _, entry := range entries {
+		routes = append(routes, entry.address.Masked())
+	}
+
+	var installed[] netip.Prefix
+	for _, route := range tunnel.routes {
+		if slices.Contains(routes, route) {
+			installed = append(installed, route)
+		} else {
+			remove_route(cfg.dev, route, tunnel.port)
+		}
+	}
+	for _, route := range routes {
+		if slices.Contains(installed, route) { continue }
+		err := setup_route("add", cfg.dev, route, tunnel.port)
+		if err != nil {
+			log_err("Failed to install route %s: %s", route.String(), err.Error())
+			continue
+		}
+		installed = append(installed, route)
+	}
+	tunnel.routes = installed
 }
 
-func setup_tunnel(str http3.Stream, local http3.Datagrammer, remote http3.Datagrammer, port int) {
+func setup_tunnel(str http3.Stream, remote http3.Datagrammer) *Connection {
 	defer wg.Done()
-	log_info("Setting up VPN tunnel over stream %d from port %d", str.StreamID(), port)
-	var request_id = 1
+	log_info("Setting up VPN tunnel over stream %d from port %d", str.StreamID(), tunnel.port)
+	requests := get_address_requests()
 	var conn *Connection
 
-	log_info("Requesting IP address with id %d", request_id)
+	log_info("Requesting %d IP addresses", len(requests))
 	var buf bytes.Buffer
-	err := RequestAddress(&buf, request_id, netip.MustParseAddr(cfg.iprequest))
+	err := RequestAddress(&buf, requests)
 	if err != nil { panic(err) }
 	str.Write(buf.Bytes())
 
@@ -110,18 +467,41 @@ func setup_tunnel(str http3.Stream, local http3.Datagrammer, remote http3.Datagr
 
 		switch capsule.typ {
 		case ADDRESS_ASSIGN:
-			AddConnection(local, capsule.address.Addr(), "")
-			conn = AddConnection(remote, DEFAULT_IP, "")
-			conn.port = port
-			setup_ip(capsule.address)
+			if conn != nil {
+				log_warn("Ignoring repeated address assignment")
+				continue
+			}
+
+			err = update_addresses(capsule.entries, requests)
+			if err != nil {
+				log_err("%s, closing tunnel", err.Error())
+				str.Close()
+				return nil
+			}
+			conn = NewConnection(remote, []netip.Prefix{ DEFAULT_PREFIX }, "", nil, nil)
+			err = AddConnection(conn)
+			if err != nil {
+				log_err("%s, closing tunnel", err.Error())
+				str.Close()
+				return nil
+			}
+			set_tunnel_state(TUNNEL_ESTABLISHED)
+
+			advertise := parse_prefixes(cfg.advertise)
+			if len(advertise) > 0 {
+				log_info("Advertising %d local routes", len(advertise))
+				buf.Reset()
+				err = AddressRange(&buf, advertise, 0)
+				if err != nil { panic(err) }
+				str.Write(buf.Bytes())
+			}
 
 		case ROUTE_ADVERTISEMENT:
 			if conn == nil {
 				log_err("Ignoring route advertisement without address assignment")
 				continue;
 			}
-			conn.routes = append(conn.routes, capsule.address)
-			setup_route("add", capsule.address, port)
+			update_routes(capsule.entries)
 
 		default:
 			log_warn("Ignoring unsupported capsule %d", capsule.typ)
@@ -130,7 +510,7 @@ func setup_tunnel(str http3.Stream, local http3.Datagrammer, remote http3.Datagr
 
 	if conn != nil {
 		log_info("Shutting down VPN connection with rx %s / tx %s",
-			get_byte_unit(conn.rx_bytes, 0), get_byte_unit(conn.tx_bytes, 0))
+			get_byte_unit(int(conn.rx_bytes.Load()), 0), get_byte_unit(int(conn.tx_bytes.Load()), 0))
 	}
+	return conn
 }
-
@@ -0,0 +1,172 @@
+//go:build client
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Reset the tunnel state kept across reconnects
+func use_tunnel_state(t *testing.T) {
+	old_dev := cfg.dev
+	old_advertise := cfg.advertise
+	cfg.dev = "tun0"
+	cfg.advertise = ""
+	use_empty_fib(t)
+	t.Cleanup(func() {
+		cfg.dev = old_dev
+		cfg.advertise = old_advertise
+		tunnel.local = nil
+		tunnel.prefixes = nil
+		tunnel.routes = nil
+		tunnel.port = 0
+	})
+	tunnel.local = NewConnection(new_chan_datagrammer(), nil, "", nil, nil)
+	tunnel.port = 443
+}
+
+func test_entries(prefixes ...string) []capsule_entry {
+	var entries[] capsule_entry
+	for i, prefix := range prefixes {
+		entries = append(entries, capsule_entry{ reqid: i + 1, address: netip.MustParsePrefix(prefix) })
+	}
+	return entries
+}
+
+func TestParseIprequest(t *testing.T) {
+	tests := []struct {
+		iprequest string
+		want[] string
+	}{
+		{ "0.0.0.0", []string{ "0.0.0.0/32" } },
+		{ "10.0.0.5 ::/0", []string{ "10.0.0.5/32", "::/0" } },
+		{ "2001:db8::/56", []string{ "2001:db8::/56" } },
+		{ "10.0.0.300", nil },
+		{ "10.0.0.0/33", nil },
+		{ "", nil },
+	}
+	for _, test := range tests {
+		requests, err := parse_iprequest(test.iprequest)
+		if test.want == nil {
+			if err == nil { t.Errorf("Invalid %q accepted", test.iprequest) }
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parsing %q failed: %s", test.iprequest, err)
+			continue
+		}
+		if len(requests) != len(test.want) {
+			t.Errorf("Parsing %q gave %d requests, want %d", test.iprequest, len(requests), len(test.want))
+			continue
+		}
+		for i, request := range requests {
+			if request.reqid != i + 1 || request.address.String() != test.want[i] {
+				t.Errorf("Request %d of %q is %d %s, want %s", i, test.iprequest, request.reqid, request.address, test.want[i])
+			}
+		}
+	}
+}
+
+func TestGetBackoff(t *testing.T) {
+	old_delay, old_max := cfg.reconnect_delay, cfg.reconnect_max_delay
+	t.Cleanup(func() { cfg.reconnect_delay, cfg.reconnect_max_delay = old_delay, old_max })
+	cfg.reconnect_delay = 1
+	cfg.reconnect_max_delay = 60
+
+	tests := []struct {
+		attempt int
+		delay time.Duration
+	}{
+		{ 1, 1 * time.Second },
+		{ 2, 2 * time.Second },
+		{ 4, 8 * time.Second },
+		{ 6, 32 * time.Second },
+		{ 7, 60 * time.Second },
+		{ 30, 60 * time.Second },
+		{ 1000, 60 * time.Second },
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			backoff := get_backoff(test.attempt)
+			if backoff < test.delay / 2 || backoff > test.delay {
+				t.Fatalf("Backoff %s of attempt %d not within %s and %s", backoff, test.attempt, test.delay / 2, test.delay)
+			}
+		}
+	}
+
+	// jitter spreads the delays
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		seen[get_backoff(7)] = true
+	}
+	if len(seen) < 2 { t.Errorf("Backoff without jitter") }
+}
+
+func TestUpdateAddresses(t *testing.T) {
+	backend := use_fake_backend(t)
+	use_tunnel_state(t)
+	requests := test_entries("0.0.0.0/32", "::/0")
+
+	err := update_addresses(test_entries("10.0.0.2/32", "2001:db8:1::/64"), requests)
+	if err != nil { t.Fatal(err) }
+	want := []string{ "link_up tun0", "addr_add tun0 10.0.0.2/32", "link_up tun0", "addr_add tun0 2001:db8:1::1/128" }
+	if calls := backend.get_calls(); !slices.Equal(calls, want) {
+		t.Errorf("Calls %v, want %v", calls, want)
+	}
+	if conn, ok := fib_lookup(netip.MustParseAddr("2001:db8:1::5")); !ok || conn != tunnel.local {
+		t.Errorf("Delegated prefix not routed to the tun device")
+	}
+
+	// a reconnect keeps the same address and replaces the other one
+	err = update_addresses(test_entries("10.0.0.2/32", "2001:db8:2::/64"), requests)
+	if err != nil { t.Fatal(err) }
+	want = []string{ "link_up tun0", "addr_add tun0 2001:db8:2::1/128", "addr_del tun0 2001:db8:1::1/128" }
+	if calls := backend.get_calls(); !slices.Equal(calls, want) {
+		t.Errorf("Calls %v, want %v", calls, want)
+	}
+	if _, ok := fib_lookup(netip.MustParseAddr("2001:db8:1::5")); ok {
+		t.Errorf("Old prefix still routed")
+	}
+
+	// unknown requests and failed addresses are skipped
+	backend.fail = map[string]error{ "addr_add tun0 10.0.0.3/32": errors.New("failed") }
+	entries := append(test_entries("10.0.0.3/32"), capsule_entry{ reqid: 3, address: netip.MustParsePrefix("10.0.0.4/32") })
+	err = update_addresses(entries, requests)
+	if err == nil { t.Errorf("No usable address accepted") }
+	if !slices.Equal(tunnel.prefixes, []netip.Prefix{ netip.MustParsePrefix("10.0.0.2/32"), netip.MustParsePrefix("2001:db8:2::/64") }) {
+		t.Errorf("Prefixes changed to %v after failure", tunnel.prefixes)
+	}
+}
+
+func TestUpdateRoutes(t *testing.T) {
+	backend := use_fake_backend(t)
+	use_tunnel_state(t)
+
+	update_routes(test_entries("10.1.0.0/16", "10.2.3.4/24"))
+	want := []string{ "route add tun0 10.1.0.0/16 254", "route add tun0 10.2.3.0/24 254" }
+	if calls := backend.get_calls(); !slices.Equal(calls, want) {
+		t.Errorf("Calls %v, want %v", calls, want)
+	}
+
+	// only the difference is applied, failed routes are not recorded
+	backend.fail = map[string]error{ "route add tun0 10.4.0.0/16 254": errors.New("failed") }
+	update_routes(test_entries("10.2.3.0/24", "10.3.0.0/16", "10.4.0.0/16"))
+	want = []string{ "route del tun0 10.1.0.0/16 254", "route add tun0 10.3.0.0/16 254", "route add tun0 10.4.0.0/16 254" }
+	if calls := backend.get_calls(); !slices.Equal(calls, want) {
+		t.Errorf("Calls %v, want %v", calls, want)
+	}
+	if !slices.Equal(tunnel.routes, []netip.Prefix{ netip.MustParsePrefix("10.2.3.0/24"), netip.MustParsePrefix("10.3.0.0/16") }) {
+		t.Errorf("Installed routes %v", tunnel.routes)
+	}
+
+	// the failed route is retried with the next advertisement
+	backend.fail = nil
+	update_routes(test_entries("10.2.3.0/24", "10.3.0.0/16", "10.4.0.0/16"))
+	want = []string{ "route add tun0 10.4.0.0/16 254" }
+	if calls := backend.get_calls(); !slices.Equal(calls, want) {
+		t.Errorf("Calls %v, want %v", calls, want)
+	}
+}
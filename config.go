@@ -2,11 +2,10 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"crypto/rand"
-	"crypto/sha256"
-	"crypto/subtle"
 	"encoding/base64"
-	"encoding/hex"
 	"flag"
 	"fmt"
 	"net/netip"
@@ -14,6 +13,8 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
+	"strconv"
 	"strings"
 	"syscall"
 )
@@ -22,47 +23,232 @@ var BUILD_NAME = "h3tunnel"
 var BUILD_VERSION = "unknown"
 var BUILD_DATE = "unkown"
 
-var MASQUE_PATH = "/.well-known/masque/ip/*/*/"
+var MASQUE_PATH = "/.well-known/masque/ip/{target}/{ipproto}/"
+
+// Only writable by root, like the tun device setup requires anyway
+const ADMIN_SOCKET = "/run/h3tunnel.sock"
+
+// RFC 9220 extended CONNECT
+const CONNECT_IP_PROTOCOL = "connect-ip"
+const SETTINGS_ENABLE_CONNECT_PROTOCOL = 0x08
 
 var wg sync.WaitGroup
+var users_sync sync.RWMutex
+var routes_sync sync.RWMutex
 
 var cfg struct {
+	reloadConfig
+
 	done chan os.Signal
+	reload chan os.Signal
+	cmdline map[string]bool
+	reload_watch int
 	debug bool
 	log_prefix string
+	log_format string
+	log_target string
+	metrics string
 	benchmark bool
+	legacy_datagrams bool
 	config_file string
-	users_file string
 
 	port int
 
 	dev string
 	mtu int
 	netns string
+	net_backend string
+
+	acme string
+	acme_directory string
+	acme_email string
+	acme_cache string
+	acme_challenge string
+	acme_listen string
+	acme_ca string
+
+	listen string
+	client_auth bool
+	crl_refresh int
+
+	admin_socket string
+
+	uri_template string
+
+	hostname string
+	target string
+	ipproto string
+	iprequest string
+	advertise string
+	username string
+	password string
+	token_file string
+	token_command string
+
+	reconnect bool
+	reconnect_attempts int
+	reconnect_delay int
+	reconnect_max_delay int
+	failback int
+
+	accounting_file string
+	radius_server string
+	radius_secret string
+
+	leases_file string
+
+	vhosts string
+}
+
+// Options replaced as a whole on reload
+type reloadConfig struct {
+	users_file string
+	password_hash string
 
 	tls_ca string
+	tls_client_ca string
 	tls_cert string
 	tls_key string
 
-	listen string
 	ippool string
 	max_pool_size int
+	delegate_length int
+	pool_exhausted string
+	pool_queue_timeout int
+	idle_timeout int
+	lease_time int
 	addroutes string
-	client_auth bool
 
-	hostname string
-	iprequest string
-	username string
+	tls_identity string
+	tls_issuer_allow string
+	tls_issuer_deny string
+	tls_crl string
+	ocsp string
+
+	jwt_jwks string
+	jwt_issuer string
+	jwt_audience string
+	jwt_user_claim string
+	jwt_groups_claim string
+	jwt_groups string
+}
+
+var reloaded atomic.Pointer[reloadConfig]
+
+// Current reloadable options, the startup values until the first reload
+func rcfg() *reloadConfig {
+	c := reloaded.Load()
+	if c == nil { return &cfg.reloadConfig }
+	return c
+}
+
+// Reloadable options by flag name
+func (c *reloadConfig) options() map[string]any {
+	return map[string]any{
+		"users_file": &c.users_file,
+		"password_hash": &c.password_hash,
+		"ca": &c.tls_ca,
+		"client_ca": &c.tls_client_ca,
+		"cert": &c.tls_cert,
+		"key": &c.tls_key,
+		"pool": &c.ippool,
+		"max_pool_size": &c.max_pool_size,
+		"delegate_length": &c.delegate_length,
+		"pool_exhausted": &c.pool_exhausted,
+		"pool_queue_timeout": &c.pool_queue_timeout,
+		"idle_timeout": &c.idle_timeout,
+		"lease_time": &c.lease_time,
+		"routes": &c.addroutes,
+		"tls_identity": &c.tls_identity,
+		"tls_issuer_allow": &c.tls_issuer_allow,
+		"tls_issuer_deny": &c.tls_issuer_deny,
+		"crl": &c.tls_crl,
+		"ocsp": &c.ocsp,
+		"jwt_jwks": &c.jwt_jwks,
+		"jwt_issuer": &c.jwt_issuer,
+		"jwt_audience": &c.jwt_audience,
+		"jwt_user_claim": &c.jwt_user_claim,
+		"jwt_groups_claim": &c.jwt_groups_claim,
+		"jwt_groups": &c.jwt_groups,
+	}
+}
+
+// Reloadable options at their defaults, options given on the command line keep their value
+func default_reload_config() reloadConfig {
+	var c reloadConfig
+	for name := range c.options() {
+		f := flag.Lookup(name)
+		if f == nil { continue }
+		value := f.DefValue
+		if cfg.cmdline[name] { value = f.Value.String() }
+		c.set(name, value)
+	}
+	return c
+}
+
+func (c *reloadConfig) set(name string, value string) error {
+	switch p := c.options()[name].(type) {
+	case *string:
+		*p = value
+	case *int:
+		v, err := strconv.Atoi(value)
+		if err != nil { return fmt.Errorf("Invalid value %s for %s", value, name) }
+		*p = v
+	default:
+		return errors.New("Option "+name+" can not be reloaded")
+	}
+	return nil
+}
+
+type userEntry struct {
 	password string
+	addresses[] netip.Addr
+	routes[] netip.Prefix
+}
 
-	users map[string][]byte
-	local_ip netip.Prefix
+// Users, address pool, routes and TLS settings served under one or more SNI names
+type vhost struct {
+	name string
+	config_file string
+	hostnames[] string
+	users_file string
+	leases_file string
+	client_auth bool
+	bearer atomic.Bool
+	dev string
+	users map[string]*userEntry
 	routes[] netip.Prefix
+	ipam ipamPool
+	tls atomic.Pointer[tls.Config]
+	uplink *Connection
+}
+
+// Main configuration, used for clients without a matching virtual host
+var default_host = &vhost{ name: "default" }
+var vhosts[] *vhost
+
+func all_hosts() []*vhost {
+	return append([]*vhost{ default_host }, vhosts...)
 }
 
 func setup_signals() {
 	cfg.done = make(chan os.Signal, 1)
 	signal.Notify(cfg.done, syscall.SIGINT, syscall.SIGTERM)
+	cfg.reload = make(chan os.Signal, 1)
+	signal.Notify(cfg.reload, syscall.SIGHUP)
+}
+
+func parse_prefixes(prefixes string) []netip.Prefix {
+	var result[] netip.Prefix
+	for _, field := range strings.Fields(prefixes) {
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			log_err("Failed to parse prefix %s: %s", field, err.Error())
+			continue
+		}
+		result = append(result, prefix.Masked())
+	}
+	return result
 }
 
 func read_stdin(prompt string) string {
@@ -123,18 +309,27 @@ func write_config(cfgfile string) {
 	f.Close()
 }
 
-func authenticate(username, password string) bool {
-	local_password, ok := cfg.users[username]
-	remote_password := sha256.Sum256([]byte(password))
+func (h *vhost) authenticate(username, password string) bool {
+	hash := ""
+	users_sync.RLock()
+	user, ok := h.users[username]
+	if ok {
+		hash = user.password
+	}
+	users_sync.RUnlock()
 
 	// burn same CPU time for valid and invalid user
-	if ok {
-		ok = (subtle.ConstantTimeCompare(local_password[:], remote_password[:]) == 1)
-	} else {
-		ok = (subtle.ConstantTimeCompare(remote_password[:], remote_password[:]) != 1)
+	if hash == "" {
+		verify_password(get_dummy_hash(), password)
+		return false
 	}
 
-	return ok
+	if !verify_password(hash, password) { return false }
+
+	if is_legacy_hash(hash) {
+		h.upgrade_password(username, hash, password)
+	}
+	return true
 }
 
 func get_random_password(length int) string {
@@ -151,41 +346,152 @@ func get_random_password(length int) string {
 	return pass
 }
 
-func get_hashed_password(password string) []byte {
-	if len(password) == 64 {
-		data, err := hex.DecodeString(password)
-		if err == nil { return data }
+// Known options of a users file entry
+var user_options = map[string]bool{ "address": true, "routes": true }
+
+// Password and options of a users file entry, only trailing words with a known option
+// key are options and everything before is the password, which may contain spaces
+func split_user_fields(value string) (string, bool, []string) {
+	password := strings.TrimSpace(value)
+	var options[] string
+	for {
+		i := strings.LastIndexAny(password, " \t")
+		if i < 0 { break }
+		key, _, found := strings.Cut(password[i+1:], "=")
+		if !found || !user_options[key] { break }
+		options = append([]string{ password[i+1:] }, options...)
+		password = strings.TrimRight(password[:i], " \t")
+	}
+	return password, password == "*", options
+}
+
+// Parse `password [address=IP]... [routes=PREFIX,...]`, a password of * disables basic auth
+func parse_user(username string, value string) *userEntry {
+	user := &userEntry{}
+	password, disabled, options := split_user_fields(value)
+	if !disabled {
+		user.password = password
+	}
+
+	for _, option := range options {
+		key, val, _ := strings.Cut(option, "=")
+		switch key {
+		case "address":
+			addr, err := netip.ParseAddr(val)
+			if err != nil {
+				log_err("Invalid address %s for user %s: %s", val, username, err.Error())
+				continue
+			}
+			user.addresses = append(user.addresses, addr)
+		case "routes":
+			for _, route := range strings.Split(val, ",") {
+				prefix, err := netip.ParsePrefix(route)
+				if err != nil {
+					log_err("Invalid route %s for user %s: %s", route, username, err.Error())
+					continue
+				}
+				user.routes = append(user.routes, prefix.Masked())
+			}
+		}
+	}
+	return user
+}
+
+func (h *vhost) get_users_file() string {
+	users_sync.RLock()
+	defer users_sync.RUnlock()
+	return h.users_file
+}
+
+func (h *vhost) get_routes() []netip.Prefix {
+	routes_sync.RLock()
+	defer routes_sync.RUnlock()
+	return h.routes
+}
+
+func (h *vhost) set_routes(routes []netip.Prefix) {
+	routes_sync.Lock()
+	h.routes = routes
+	routes_sync.Unlock()
+}
+
+func (h *vhost) get_user_address(username string, is4 bool) netip.Addr {
+	users_sync.RLock()
+	defer users_sync.RUnlock()
+	user, ok := h.users[username]
+	if !ok { return netip.Addr{} }
+	for _, addr := range user.addresses {
+		if addr.Is4() == is4 { return addr }
+	}
+	return netip.Addr{}
+}
+
+func (h *vhost) get_address_user(prefix netip.Prefix) string {
+	users_sync.RLock()
+	defer users_sync.RUnlock()
+	for username, user := range h.users {
+		for _, user_addr := range user.addresses {
+			if prefix.Contains(user_addr) { return username }
+		}
 	}
+	return ""
+}
 
-	data := sha256.Sum256([]byte(password))
-	return data[:]
+// Client advertised route must be inside a route allowed for the user
+func (h *vhost) user_route_allowed(username string, route netip.Prefix) bool {
+	users_sync.RLock()
+	defer users_sync.RUnlock()
+	user, ok := h.users[username]
+	if !ok || route.Bits() == 0 { return false }
+	for _, allowed := range user.routes {
+		if allowed.Bits() <= route.Bits() && allowed.Contains(route.Addr()) {
+			return true
+		}
+	}
+	return false
 }
 
-func load_userdb(filename string) {
-	cfg.users = make(map[string][]byte)
-	for user, pass := range read_config(filename, false) {
-		cfg.users[user] = get_hashed_password(pass)
+func read_userdb(filename string) (map[string]*userEntry, error) {
+	_, err := os.Stat(filename)
+	if err != nil { return nil, err }
+
+	users := make(map[string]*userEntry)
+	for user, value := range read_config(filename, false) {
+		users[user] = parse_user(user, value)
 	}
+	return users, nil
+}
 
-	if len(cfg.users) > 0 {
-		log_info("Found %d users in local database", len(cfg.users))
+func (h *vhost) load_userdb(filename string, demo bool) {
+	users, err := read_userdb(filename)
+	if err != nil {
+		users = make(map[string]*userEntry)
+	}
+	h.users_file = filename
+	h.users = users
+
+	if len(h.users) > 0 || !demo {
+		log_info("Found %d users in local database of %s", len(h.users), h.name)
 		return
 	}
 
 	// generate temporary demo user with random passwort
 	pass := get_random_password(10)
-	cfg.users["demo"] = get_hashed_password(pass)
+	h.users["demo"] = &userEntry{ password: hash_password(pass) }
 	log_err("Generated user demo with password %s", pass)
 }
 
 func get_file_config(filename string) {
+	cfg.cmdline = map[string]bool{}
+	flag.Visit(func(i *flag.Flag) {
+		cfg.cmdline[i.Name] = true
+	})
+
 	config := read_config(filename, true)
 	for key, _ := range config {
-		flag.Visit(func(i *flag.Flag) {
-			if i.Name != key { return }
-			log_info("Configuration %s overriden by command line argument", key)
-			delete(config, key)
-		})
+		if !cfg.cmdline[key] { continue }
+		log_info("Configuration %s overriden by command line argument", key)
+		delete(config, key)
 	}
 
 	for key, option := range config {
@@ -198,14 +504,20 @@ func get_config() {
 
 	flag.BoolVar(&cfg.debug, "debug", false, "debug mode")
 	flag.StringVar(&cfg.log_prefix, "log_prefix", "", "Log prefix")
+	flag.StringVar(&cfg.log_format, "log_format", "text", "Log format on stderr: text or json")
+	flag.StringVar(&cfg.log_target, "log_target", "stderr", "Log destination: stderr, syslog or journald")
+	flag.StringVar(&cfg.metrics, "metrics", "", "Listen address of the Prometheus metrics endpoint, empty to disable")
 	flag.BoolVar(&cfg.benchmark, "benchmark", false, "run benchmark after connect")
 
 	flag.IntVar(&cfg.port, "port", 443, "quic port")
-	flag.StringVar(&cfg.tls_ca, "ca", "", "TLS CA file. If not set system CAs will be used")
+	flag.StringVar(&cfg.tls_ca, "ca", "", "TLS CA files or directories, system adds the system CAs. If not set system CAs will be used")
+	flag.StringVar(&cfg.uri_template, "uri_template", MASQUE_PATH, "connect-ip URI template path")
 
 	flag.StringVar(&cfg.dev, "dev", "vpn%d", "network device")
 	flag.IntVar(&cfg.mtu, "mtu", 1350, "MTU size")
 	flag.StringVar(&cfg.netns, "netns", "", "Net Namespace for tun device")
+	flag.StringVar(&cfg.net_backend, "net_backend", "netlink", "Network configuration backend: netlink or iproute2")
+	flag.BoolVar(&cfg.legacy_datagrams, "legacy_datagrams", false, "Send datagrams without context ID for older h3tunnel peers")
 
 	flag.StringVar(&cfg.config_file, "config_file", filename+".cfg", "Configuration file to read")
 
@@ -216,33 +528,111 @@ func get_config() {
 	if cfg.debug {
 		MAX_LOGLEVEL = LOG_DEBUG
 	}
+	log_init()
 	setup_signals()
 
 	log_info("Starting %s %s version %s build %s", BUILD_NAME, BUILD_TYPE, BUILD_VERSION, BUILD_DATE)
 }
 
-func get_server_config() {
+func server_flags() {
 	flag.StringVar(&cfg.listen, "listen", "0.0.0.0", "listening address")
-	flag.StringVar(&cfg.ippool, "pool", "11.0.0.1/24", "IPv4 or IPv6 address pool")
+	flag.StringVar(&cfg.ippool, "pool", "11.0.0.1/24", "IPv4 and/or IPv6 address pools")
 	flag.IntVar(&cfg.max_pool_size, "max_pool_size", 32, "Maximum number of concurrent connections")
+	flag.IntVar(&cfg.delegate_length, "delegate_length", 128, "Prefix length delegated to each client from IPv6 pools, clients may request a longer one")
+	flag.StringVar(&cfg.pool_exhausted, "pool_exhausted", "reject", "Policy if address pool is exhausted: reject, queue or evict")
+	flag.IntVar(&cfg.pool_queue_timeout, "pool_queue_timeout", 30, "Seconds to wait for a free address with queue or evict policy")
+	flag.IntVar(&cfg.idle_timeout, "idle_timeout", 300, "Seconds without traffic before a connection may be evicted")
 	flag.StringVar(&cfg.addroutes, "routes", "", "Additional routes to install")
-	flag.StringVar(&cfg.users_file, "users_file", "users.db", "User database")
+	flag.StringVar(&cfg.users_file, "users_file", "users.db", "User database with lines user: password [address=IP] [routes=PREFIX,...], * to disable")
+	flag.IntVar(&cfg.reload_watch, "reload_watch", 0, "Seconds between checks for changed configuration files, 0 to reload on SIGHUP only")
+	flag.StringVar(&cfg.password_hash, "password_hash", "argon2id", "Hash for new and upgraded passwords: argon2id or bcrypt")
+	flag.StringVar(&cfg.leases_file, "leases_file", "leases.db", "IP address lease database")
+	flag.IntVar(&cfg.lease_time, "lease_time", 86400, "Seconds an address stays reserved for a user after disconnect")
+	flag.StringVar(&cfg.admin_socket, "admin_socket", ADMIN_SOCKET, "Unix socket for the admin API, empty to disable. Users disabled through it stay disabled until restart")
+	flag.StringVar(&cfg.accounting_file, "accounting_file", "", "Append one JSON record per session to this file")
+	flag.StringVar(&cfg.radius_server, "radius_server", "", "RADIUS accounting server host:port")
+	flag.StringVar(&cfg.radius_secret, "radius_secret", "", "RADIUS shared secret")
 	flag.BoolVar(&cfg.client_auth, "client_auth", false, "Require mutual client authentication")
+	flag.StringVar(&cfg.tls_client_ca, "client_ca", "", "CA files or directories for client certificates, defaults to ca, system is not allowed")
+	flag.StringVar(&cfg.tls_crl, "crl", "", "CRL files checked for revoked client certificates")
+	flag.IntVar(&cfg.crl_refresh, "crl_refresh", 3600, "Seconds between CRL reloads, 0 to disable")
+	flag.StringVar(&cfg.ocsp, "ocsp", "off", "OCSP check of client certificates: off, soft or hard")
+	flag.StringVar(&cfg.tls_identity, "tls_identity", "email", "Rules mapping client certificates to users: field [regex [template]];...")
+	flag.StringVar(&cfg.tls_issuer_allow, "tls_issuer_allow", "", "Client certificate issuers, any CA of the chain, to accept as sha256:<key hash> or certificate file, separated by ;")
+	flag.StringVar(&cfg.tls_issuer_deny, "tls_issuer_deny", "", "Client certificate issuers, any CA of the chain, to reject as sha256:<key hash> or certificate file, separated by ;")
+	flag.StringVar(&cfg.jwt_jwks, "jwt_jwks", "", "JWKS file or URL to accept bearer tokens on the main host and virtual hosts with bearer: true, empty to disable")
+	flag.StringVar(&cfg.jwt_issuer, "jwt_issuer", "", "Required issuer of bearer tokens")
+	flag.StringVar(&cfg.jwt_audience, "jwt_audience", "", "Required audience of bearer tokens")
+	flag.StringVar(&cfg.jwt_user_claim, "jwt_user_claim", "sub", "Token claim used as username")
+	flag.StringVar(&cfg.jwt_groups_claim, "jwt_groups_claim", "groups", "Token claim listing the groups of the user")
+	flag.StringVar(&cfg.jwt_groups, "jwt_groups", "", "Groups allowed to connect with a bearer token, empty for all")
 	flag.StringVar(&cfg.tls_cert, "cert", "fullchain.pem", "TLS certificate file")
 	flag.StringVar(&cfg.tls_key, "key", "privkey.pem", "TLS private key file")
+	flag.StringVar(&cfg.vhosts, "vhosts", "", "Virtual host configuration files, selected by SNI. Each needs its own cert and key, ACME is not used for them")
+	flag.StringVar(&cfg.acme, "acme", "", "Hostnames to obtain certificates for via ACME instead of cert and key, not for virtual hosts")
+	flag.StringVar(&cfg.acme_directory, "acme_directory", "https://acme-v02.api.letsencrypt.org/directory", "ACME directory URL")
+	flag.StringVar(&cfg.acme_email, "acme_email", "", "Contact email for the ACME account")
+	flag.StringVar(&cfg.acme_cache, "acme_cache", "acme", "Directory storing the ACME account key and certificates")
+	flag.StringVar(&cfg.acme_challenge, "acme_challenge", "tls-alpn-01", "ACME challenge: tls-alpn-01 or http-01")
+	flag.StringVar(&cfg.acme_listen, "acme_listen", "", "TCP listen address for ACME challenges, defaults to :443 or :80")
+	flag.StringVar(&cfg.acme_ca, "acme_ca", "", "CA files trusted for the ACME directory, default system CAs")
+}
+
+func get_server_config() {
+	server_flags()
 	get_config()
 
-	if !cfg.client_auth {
-		load_userdb(cfg.users_file)
+	err := check_server_config()
+	if err != nil { log_fatal("%s", err.Error()) }
+
+	default_host.client_auth = cfg.client_auth
+	default_host.leases_file = cfg.leases_file
+	default_host.load_userdb(cfg.users_file, !cfg.client_auth)
+}
+
+func check_server_config() error {
+	if cfg.acme_challenge != "tls-alpn-01" && cfg.acme_challenge != "http-01" {
+		return errors.New("Invalid ACME challenge "+cfg.acme_challenge)
+	}
+	if cfg.radius_server != "" && cfg.radius_secret == "" {
+		return errors.New("RADIUS server requires a shared secret")
+	}
+	return check_reload_config(&cfg.reloadConfig)
+}
+
+func check_reload_config(c *reloadConfig) error {
+	switch c.pool_exhausted {
+	case "reject", "queue", "evict":
+	default:
+		return errors.New("Invalid pool exhaustion policy "+c.pool_exhausted)
+	}
+	if c.password_hash != "argon2id" && c.password_hash != "bcrypt" {
+		return errors.New("Invalid password hash "+c.password_hash)
+	}
+	switch c.ocsp {
+	case "off", "soft", "hard":
+	default:
+		return errors.New("Invalid OCSP mode "+c.ocsp)
 	}
+	return nil
 }
 
 func get_client_config() {
-	flag.StringVar(&cfg.hostname, "hostname", "", "remote server")
-	flag.StringVar(&cfg.iprequest, "iprequest", "0.0.0.0", "IPv4 or IPv6 address to request")
+	flag.StringVar(&cfg.hostname, "hostname", "", "Remote servers as host[:port][/weight] or srv:_name._udp.domain list")
+	flag.StringVar(&cfg.iprequest, "iprequest", "0.0.0.0", "IPv4 and/or IPv6 addresses or prefixes to request")
+	flag.StringVar(&cfg.advertise, "advertise", "", "Local subnets to advertise to the server")
+	flag.StringVar(&cfg.target, "target", "*", "Tunnel scope target prefix or hostname")
+	flag.StringVar(&cfg.ipproto, "ipproto", "*", "Tunnel scope IP protocol")
 	flag.StringVar(&cfg.username, "username", "", "username")
 	flag.StringVar(&cfg.password, "password", "", "password")
+	flag.StringVar(&cfg.token_file, "token_file", "", "File with a bearer token used instead of username and password")
+	flag.StringVar(&cfg.token_command, "token_command", "", "Command printing a bearer token used instead of username and password")
 	flag.StringVar(&cfg.tls_cert, "cert", "", "mTLS certificate file")
 	flag.StringVar(&cfg.tls_key, "key", "", "mTLS private key file")
+	flag.BoolVar(&cfg.reconnect, "reconnect", true, "Reconnect if the connection to the server is lost")
+	flag.IntVar(&cfg.reconnect_attempts, "reconnect_attempts", 0, "Reconnect attempts before giving up, 0 for unlimited")
+	flag.IntVar(&cfg.reconnect_delay, "reconnect_delay", 1, "Initial reconnect delay in seconds")
+	flag.IntVar(&cfg.reconnect_max_delay, "reconnect_max_delay", 60, "Maximum reconnect delay in seconds")
+	flag.IntVar(&cfg.failback, "failback", 0, "Probe interval in seconds to move back to a preferred server, 0 to disable")
 	get_config()
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParseUser(t *testing.T) {
+	tests := []struct {
+		value string
+		password string
+		addresses[] netip.Addr
+		routes[] netip.Prefix
+	}{
+		{ value: "secret", password: "secret" },
+		{ value: "*" },
+		{ value: "pass word with spaces", password: "pass word with spaces" },
+		{ value: "$legacy pass", password: "$legacy pass" },
+		{ value: "secret address=10.0.0.5", password: "secret",
+			addresses: []netip.Addr{ netip.MustParseAddr("10.0.0.5") } },
+		{ value: "pass word  address=10.0.0.5 address=2001:db8::5 routes=192.168.1.7/24,10.1.0.0/16", password: "pass word",
+			addresses: []netip.Addr{ netip.MustParseAddr("10.0.0.5"), netip.MustParseAddr("2001:db8::5") },
+			routes: []netip.Prefix{ netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("10.1.0.0/16") } },
+		{ value: "a=b c=d", password: "a=b c=d" },
+		{ value: "routes=10.0.0.0/8 secret", password: "routes=10.0.0.0/8 secret" },
+		{ value: "address=10.0.0.5", password: "address=10.0.0.5" },
+	}
+	for _, test := range tests {
+		user := parse_user("alice", test.value)
+		if user.password != test.password || !slices.Equal(user.addresses, test.addresses) || !slices.Equal(user.routes, test.routes) {
+			t.Errorf("parse_user(%q) = %q %v %v, want %q %v %v", test.value, user.password, user.addresses, user.routes, test.password, test.addresses, test.routes)
+		}
+	}
+}
+
+func TestUserRouteAllowed(t *testing.T) {
+	host := &vhost{ users: map[string]*userEntry{
+		"alice": parse_user("alice", "secret routes=192.168.0.0/16,2001:db8:1::/48"),
+		"bob": parse_user("bob", "secret"),
+	} }
+	tests := []struct {
+		username string
+		route string
+		allowed bool
+	}{
+		{ "alice", "192.168.0.0/16", true },
+		{ "alice", "192.168.5.0/24", true },
+		{ "alice", "192.168.5.7/32", true },
+		{ "alice", "192.0.0.0/8", false },
+		{ "alice", "10.0.0.0/24", false },
+		{ "alice", "2001:db8:1:2::/64", true },
+		{ "alice", "2001:db8::/32", false },
+		{ "alice", "0.0.0.0/0", false },
+		{ "alice", "::/0", false },
+		{ "bob", "192.168.5.0/24", false },
+		{ "carol", "192.168.5.0/24", false },
+	}
+	for _, test := range tests {
+		allowed := host.user_route_allowed(test.username, netip.MustParsePrefix(test.route))
+		if allowed != test.allowed {
+			t.Errorf("Route %s of %s allowed %v, want %v", test.route, test.username, allowed, test.allowed)
+		}
+	}
+}
@@ -2,37 +2,58 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
 	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/quic-go/quic-go/http3"
 )
 
 type Connection struct {
 	id int
-	ip netip.Addr
+	prefixes[] netip.Prefix
 	validate_src bool
+	scope *ipScope
 	routes[] netip.Prefix
+	announced[] netip.Prefix
 	port int
 
 	user string
+	host *vhost
+	remote string
+	auth string
+	subject string
+	groups[] string
+	reason string
+	reason_lock sync.Mutex
+	cert *x509.Certificate
+	issuer *x509.Certificate
 	time time.Time
+	last_rx atomic.Int64
 
-	rx_bytes int
-	tx_bytes int
+	rx_bytes atomic.Int64
+	tx_bytes atomic.Int64
+	rx_packets atomic.Int64
+	tx_packets atomic.Int64
 
 	datagrammer http3.Datagrammer
 	tx_queue chan []byte
+	close func()
+	done chan struct{}
+	radius_stop chan []byte
 }
 var connection_ids int
-var connections map[netip.Addr](Connection)
+var connections map[int](*Connection)
 var connection_sync sync.RWMutex
 
 var DEFAULT_IP = netip.MustParseAddr("0.0.0.0")
+var DEFAULT_PREFIX = netip.PrefixFrom(DEFAULT_IP, 0)
 
 func init() {
-	connections = make(map[netip.Addr](Connection))
+	connections = make(map[int](*Connection))
 }
 
 func get_byte_unit(bytes int, time int) string {
@@ -62,101 +83,269 @@ func get_connection_id () int {
 	return connection_ids
 }
 
-func AddConnection(datagrammer http3.Datagrammer, addr netip.Addr, user string) *Connection {
-	connection_sync.Lock()
-	connection := Connection {
-		id: get_connection_id(),
-		ip: addr,
+// Connection is not visible to others until added
+func NewConnection(datagrammer http3.Datagrammer, prefixes []netip.Prefix, user string, scope *ipScope, host *vhost) *Connection {
+	conn := &Connection {
+		prefixes: prefixes,
+		scope: scope,
 		user: user,
+		validate_src: user != "",
+		host: host,
 		time: time.Now(),
 		datagrammer: datagrammer,
-		tx_queue: make(chan []byte) }
-	_, ok := connections[addr]
-	if ok { panic("IP address "+addr.String()+" already in connection table") }
-	connections[addr] = connection
+		tx_queue: make(chan []byte),
+		done: make(chan struct{}) }
+	conn.last_rx.Store(conn.time.UnixNano())
+	return conn
+}
+
+// Publish the connection and start forwarding, fails if a prefix is still routed elsewhere
+func AddConnection(conn *Connection) error {
+	connection_sync.Lock()
+	conn.id = get_connection_id()
+	err := fib_replace(nil, conn.prefixes, conn)
+	if err != nil {
+		connection_sync.Unlock()
+		return err
+	}
+	connections[conn.id] = conn
 	connection_sync.Unlock()
-	if user != "" {
-		log_info("User %s connected", user)
-		connection.validate_src = true
+	if conn.user != "" {
+		conn.log().info("User %s connected", conn.user)
 	}
 
 	wg.Add(2)
-	go connection.Receive()
-	go connection.Transmit()
+	go conn.Receive()
+	go conn.Transmit()
+	return nil
+}
 
-	return &connection
+// First reason wins, a kick is not overwritten by the stream error it causes
+func (c *Connection) set_reason(reason string) {
+	c.reason_lock.Lock()
+	defer c.reason_lock.Unlock()
+	if c.reason == "" { c.reason = reason }
+}
+
+func (c *Connection) get_reason() string {
+	c.reason_lock.Lock()
+	defer c.reason_lock.Unlock()
+	return c.reason
+}
+
+func (c *Connection) get_last_rx() time.Time {
+	return time.Unix(0, c.last_rx.Load())
 }
 
 func DelConnection(conn *Connection) {
 	if conn.user != "" {
-		log_info("User %s disconnected with rx %s / tx %s", conn.user, get_byte_unit(conn.rx_bytes, 0), get_byte_unit(conn.tx_bytes, 0))
+		conn.log().info("User %s disconnected with rx %s / tx %s", conn.user, get_byte_unit(int(conn.rx_bytes.Load()), 0), get_byte_unit(int(conn.tx_bytes.Load()), 0))
 	}
 	connection_sync.Lock()
-	delete(connections, conn.ip)
+	fib_replace(conn.prefixes, nil, conn)
+	fib_replace(conn.announced, nil, conn)
+	delete(connections, conn.id)
+	stats_close_connection(conn)
 	connection_sync.Unlock()
 	for _, route := range conn.routes {
-		setup_route("del", route, conn.port)
+		remove_route(conn.dev(), route, conn.port)
+	}
+	for _, route := range conn.announced {
+		remove_route(conn.dev(), route, conn.port)
+	}
+	close(conn.done)
+}
+
+func (c *Connection) update_prefixes(prefixes []netip.Prefix) error {
+	connection_sync.Lock()
+	defer connection_sync.Unlock()
+
+	err := fib_replace(c.prefixes, prefixes, c)
+	if err != nil { return err }
+	c.prefixes = prefixes
+	return nil
+}
+
+// Replace routes announced by the peer, each advertisement is the full set
+// Kernel routes are changed after unlocking as the backend may be slow
+func (c *Connection) announce(routes []netip.Prefix) error {
+	connection_sync.Lock()
+	err := fib_replace(c.announced, routes, c)
+	if err != nil {
+		connection_sync.Unlock()
+		return err
+	}
+	var removed, added[] netip.Prefix
+	for _, route := range c.announced {
+		if !slices.Contains(routes, route) { removed = append(removed, route) }
+	}
+	for _, route := range routes {
+		if !slices.Contains(c.announced, route) { added = append(added, route) }
+	}
+	c.announced = routes
+	connection_sync.Unlock()
+	c.log().info("Connection %d announced %d routes", c.id, len(routes))
+
+	for _, route := range removed {
+		remove_route(c.dev(), route, c.port)
+	}
+	for _, route := range added {
+		err = setup_route("add", c.dev(), route, c.port)
+		if err != nil {
+			c.log().err("Failed to install route %s: %s", route.String(), err.Error())
+		}
+	}
+	return nil
+}
+
+// Reverse path check, source must be routed back to this connection
+func (c *Connection) has_ip(addr netip.Addr) bool {
+	conn, ok := fib_lookup(addr)
+	return ok && conn == c
+}
+
+func (c *Connection) log() logFields {
+	if c.user == "" { return log_fields("conn", c.id) }
+	if c.host_name() != "" {
+		return log_fields("conn", c.id, "user", c.user, "remote", c.remote, "host", c.host_name())
 	}
+	return log_fields("conn", c.id, "user", c.user, "remote", c.remote)
+}
+
+// Virtual host of the connection, empty for the main configuration
+func (c *Connection) host_name() string {
+	if c.host == nil || c.host == default_host { return "" }
+	return c.host.name
+}
+
+// Tun device carrying the traffic of the connection
+func (c *Connection) dev() string {
+	if c.host == nil || c.host.dev == "" { return cfg.dev }
+	return c.host.dev
+}
+
+// Connection of the local tun device
+func (c *Connection) is_local() bool {
+	_, ok := c.datagrammer.(*tunDev)
+	return ok
+}
+
+func (c *Connection) has_family(is4 bool) bool {
+	for _, prefix := range c.prefixes {
+		if prefix.Addr().Is4() == is4 { return true }
+	}
+	return false
+}
+
+// Close the longest idle user connection of the given family
+func evict_idle_connection(host *vhost, is4 bool) bool {
+	var idle *Connection
+	min_idle := time.Duration(rcfg().idle_timeout) * time.Second
+
+	connection_sync.RLock()
+	for _, conn := range connections {
+		if conn.user == "" || conn.close == nil || conn.host != host || !conn.has_family(is4) {
+			continue
+		}
+		if time.Since(conn.get_last_rx()) < min_idle {
+			continue
+		}
+		if idle == nil || conn.get_last_rx().Before(idle.get_last_rx()) {
+			idle = conn
+		}
+	}
+	connection_sync.RUnlock()
+
+	if idle == nil {
+		log_err("No idle connection found to evict")
+		return false
+	}
+	idle.log().info("Evicting user %s idle since %s", idle.user, idle.get_last_rx().Format(time.RFC3339))
+	stats.evicted.Add(1)
+	idle.set_reason(REASON_IDLE_TIMEOUT)
+	idle.close()
+	return true
 }
 
 func (c *Connection) Receive() {
 	defer wg.Done()
 
-	log_debug("Starting loop for connection %d", c.id)
+	c.log().debug("Starting loop for connection %d", c.id)
 	ctx := context.Background()
 
 	for {
 		pkt, err := c.datagrammer.ReceiveMessage(ctx)
 		if err != nil {
-			log_err("Cant receive packet on connection %d: %s", c.id, err.Error());
+			c.log().err("Cant receive packet on connection %d: %s", c.id, err.Error());
 			break
 		}
 		n := len(pkt)
-		c.rx_bytes += n
+		c.rx_bytes.Add(int64(n))
+		c.rx_packets.Add(1)
+		c.last_rx.Store(time.Now().UnixNano())
 		log_debug("Received packet on connection %d with len %d", c.id, n)
 
 		// skip invalid packets, 20 is minimum for IPv4
 		if n < 20 {
-			log_err("Ignoring short packet with size %d", n)
+			c.log().err("Ignoring short packet with size %d", n)
+			stats.drop_short.Add(1)
 			continue
 		}
 
 		var src_ip netip.Addr
 		var dst_ip netip.Addr
+		var proto uint8
 
 		version := int(pkt[0] >> 4)
 		if version == 4 {
 			src_ip = netip.AddrFrom4(([4]byte)(pkt[12:]))
 			dst_ip = netip.AddrFrom4(([4]byte)(pkt[16:]))
+			proto = pkt[9]
 		} else if version == 6 {
 			if n < 40 {
-				log_err("Ignoring short IPv6 packet with size %d", n)
-				return
+				c.log().err("Ignoring short IPv6 packet with size %d", n)
+				stats.drop_short.Add(1)
+				continue
 			}
 			src_ip = netip.AddrFrom16(([16]byte)(pkt[8:]))
 			dst_ip = netip.AddrFrom16(([16]byte)(pkt[24:]))
+			// extension headers are not followed
+			proto = pkt[6]
 		} else {
-			log_err("Invalid packet received with IP version %d", version)
-			return
+			c.log().err("Invalid packet received with IP version %d", version)
+			stats.drop_invalid.Add(1)
+			continue
 		}
 
-		if (c.validate_src && c.ip.Compare(src_ip) != 0) {
-			log_debug("Dropping spoofed packet with SRC IP %s instead of %s", src_ip.String(), c.ip.String())
+		if (c.validate_src && !c.has_ip(src_ip)) {
+			log_debug("Dropping spoofed packet with SRC IP %s on connection %d", src_ip.String(), c.id)
+			stats.drop_spoofed.Add(1)
 			continue
 		}
 
-		connection_sync.RLock()
-		forward, ok := connections[dst_ip]
-		if !ok {
-			log_debug("Cant find route for %s using default", dst_ip.String())
-			forward, ok = connections[DEFAULT_IP]
+		if !c.scope.allows(dst_ip, proto) {
+			log_debug("Dropping packet to %s protocol %d outside of tunnel scope", dst_ip.String(), proto)
+			stats.drop_scope.Add(1)
+			continue
+		}
+
+		forward, ok := fib_lookup(dst_ip)
+		if ok && forward.is_local() && c.host != nil && c.host.uplink != nil {
+			forward = c.host.uplink
 		}
-		connection_sync.RUnlock()
 
 		if !ok {
 			log_debug("Cant find destination for packet")
+			stats.drop_no_route.Add(1)
 		} else if forward.id == c.id {
 			log_debug("Dropping packet with identical ingress and outgress route: %d", forward.id)
+		} else if forward.user != "" && c.user != "" && forward.host != c.host {
+			log_debug("Dropping packet from connection %d to other virtual host", c.id)
+			stats.drop_no_route.Add(1)
+		} else if !forward.scope.allows(src_ip, proto) {
+			// a scoped client only talks to its targets in both directions
+			log_debug("Dropping packet from %s protocol %d outside of tunnel scope of connection %d", src_ip.String(), proto, forward.id)
+			stats.drop_scope.Add(1)
 		} else {
 			log_debug("Forwarding packet %s %d -> %s %d", src_ip, c.id, dst_ip, forward.id)
 			forward.tx_queue <- pkt
@@ -177,11 +366,13 @@ func (c *Connection) Transmit() {
 		err := c.datagrammer.SendMessage(data)
 
 		if err != nil {
-			log_err("Cant send packet on connection %d with len %d - %s", c.id, len(data), err.Error())
+			c.log().err("Cant send packet on connection %d with len %d - %s", c.id, len(data), err.Error())
+			stats.drop_send_error.Add(1)
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		c.tx_bytes += len(data)
+		c.tx_bytes.Add(int64(len(data)))
+		c.tx_packets.Add(1)
 	}
 
 	DelConnection(c)
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func ipv4_packet(src string, dst string) []byte {
+	pkt := make([]byte, 20)
+	pkt[0] = 0x45
+	pkt[9] = 17
+	copy(pkt[12:], netip.MustParseAddr(src).AsSlice())
+	copy(pkt[16:], netip.MustParseAddr(dst).AsSlice())
+	return pkt
+}
+
+func add_test_connection(t *testing.T, prefix string, user string) (*Connection, *chanDatagrammer) {
+	datagrammer := new_chan_datagrammer()
+	conn := NewConnection(datagrammer, []netip.Prefix{ netip.MustParsePrefix(prefix) }, user, nil, default_host)
+	err := AddConnection(conn)
+	if err != nil { t.Fatal(err) }
+	return conn, datagrammer
+}
+
+func wait_connection_done(t *testing.T, conn *Connection) {
+	select {
+	case <-conn.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Connection %d not removed", conn.id)
+	}
+}
+
+func TestReceiveInvalidPackets(t *testing.T) {
+	use_empty_fib(t)
+	conn, src := add_test_connection(t, "10.0.0.2/32", "alice")
+	dst, out := add_test_connection(t, "10.0.0.3/32", "bob")
+	defer func() {
+		close(out.rx)
+		wait_connection_done(t, dst)
+	}()
+
+	short6 := make([]byte, 30)
+	short6[0] = 0x60
+	version5 := ipv4_packet("10.0.0.2", "10.0.0.3")
+	version5[0] = 0x55
+	drops := []struct{ name string; pkt []byte; counter interface{ Load() int64 } }{
+		{ "short", make([]byte, 10), &stats.drop_short },
+		{ "short IPv6", short6, &stats.drop_short },
+		{ "invalid version", version5, &stats.drop_invalid },
+		{ "spoofed", ipv4_packet("10.0.0.9", "10.0.0.3"), &stats.drop_spoofed },
+	}
+	for _, drop := range drops {
+		before := drop.counter.Load()
+		src.rx <- drop.pkt
+
+		// the connection keeps forwarding after a dropped packet
+		valid := ipv4_packet("10.0.0.2", "10.0.0.3")
+		src.rx <- valid
+		select {
+		case pkt := <-out.tx:
+			if !bytes.Equal(pkt, valid) { t.Fatalf("%s: forwarded %v", drop.name, pkt) }
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: connection stopped forwarding", drop.name)
+		}
+		if drop.counter.Load() != before + 1 {
+			t.Errorf("%s: drop not counted", drop.name)
+		}
+	}
+
+	close(src.rx)
+	wait_connection_done(t, conn)
+	if _, ok := fib_lookup(netip.MustParseAddr("10.0.0.2")); ok {
+		t.Error("Route of removed connection still present")
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	use_empty_fib(t)
+	backend := use_fake_backend(t)
+	conn, src := add_test_connection(t, "10.0.0.2/32", "alice")
+	other, out := add_test_connection(t, "10.5.0.0/16", "bob")
+	defer func() {
+		close(out.rx)
+		wait_connection_done(t, other)
+	}()
+
+	// the backend is called without holding the connection lock
+	backend.check = func(call string) {
+		if !connection_sync.TryLock() {
+			t.Errorf("%s called under connection lock", call)
+			return
+		}
+		connection_sync.Unlock()
+	}
+	route := func(mode string, prefix string) string {
+		return fmt.Sprintf("route %s %s %s %d", mode, conn.dev(), prefix, TABLE_MAIN)
+	}
+
+	err := conn.announce([]netip.Prefix{ netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("10.2.0.0/16") })
+	if err != nil { t.Fatal(err) }
+	want := []string{ route("add", "10.1.0.0/16"), route("add", "10.2.0.0/16") }
+	if calls := backend.get_calls(); !slices.Equal(calls, want) {
+		t.Errorf("Calls %v, want %v", calls, want)
+	}
+	if found, ok := fib_lookup(netip.MustParseAddr("10.1.2.3")); !ok || found != conn {
+		t.Errorf("Announced route not forwarded to the connection")
+	}
+
+	// only the difference is applied
+	err = conn.announce([]netip.Prefix{ netip.MustParsePrefix("10.2.0.0/16"), netip.MustParsePrefix("10.3.0.0/16") })
+	if err != nil { t.Fatal(err) }
+	want = []string{ route("del", "10.1.0.0/16"), route("add", "10.3.0.0/16") }
+	if calls := backend.get_calls(); !slices.Equal(calls, want) {
+		t.Errorf("Calls %v, want %v", calls, want)
+	}
+	if _, ok := fib_lookup(netip.MustParseAddr("10.1.2.3")); ok {
+		t.Errorf("Withdrawn route still forwarded")
+	}
+
+	// a prefix of another connection rejects the whole advertisement
+	err = conn.announce([]netip.Prefix{ netip.MustParsePrefix("10.4.0.0/16"), netip.MustParsePrefix("10.5.0.0/16") })
+	if err == nil { t.Errorf("Prefix of another connection accepted") }
+	if calls := backend.get_calls(); len(calls) != 0 {
+		t.Errorf("Rejected advertisement changed routes %v", calls)
+	}
+	if found, ok := fib_lookup(netip.MustParseAddr("10.3.2.1")); !ok || found != conn {
+		t.Errorf("Previous routes lost after rejected advertisement")
+	}
+
+	// announced routes are removed with the connection
+	close(src.rx)
+	wait_connection_done(t, conn)
+	want = []string{ route("del", "10.2.0.0/16"), route("del", "10.3.0.0/16") }
+	if calls := backend.get_calls(); !slices.Equal(calls, want) {
+		t.Errorf("Calls %v, want %v", calls, want)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync/atomic"
+)
+
+// Forwarding table with longest prefix match over one hash map per prefix
+// length. Lookups use an immutable snapshot without locking, updates copy
+// the table and must be serialized by connection_sync.
+type fibTable struct {
+	lengths[] int
+	routes map[netip.Prefix]*Connection
+}
+
+var fib atomic.Pointer[fibTable]
+
+func init() {
+	fib.Store(&fibTable{ routes: make(map[netip.Prefix]*Connection) })
+}
+
+func (t *fibTable) clone() *fibTable {
+	table := &fibTable{ routes: make(map[netip.Prefix]*Connection, len(t.routes)) }
+	for prefix, conn := range t.routes {
+		table.routes[prefix] = conn
+	}
+	return table
+}
+
+func (t *fibTable) update_lengths() {
+	found := map[int]bool{}
+	for prefix := range t.routes {
+		if found[prefix.Bits()] { continue }
+		found[prefix.Bits()] = true
+		t.lengths = append(t.lengths, prefix.Bits())
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(t.lengths)))
+}
+
+// Remove and add routes of a connection in one atomic table update
+func fib_replace(del []netip.Prefix, add []netip.Prefix, conn *Connection) error {
+	table := fib.Load().clone()
+	for _, prefix := range del {
+		prefix = prefix.Masked()
+		if table.routes[prefix] == conn {
+			delete(table.routes, prefix)
+		}
+	}
+	for _, prefix := range add {
+		prefix = prefix.Masked()
+		other, ok := table.routes[prefix]
+		if ok && other != conn {
+			return fmt.Errorf("prefix %s already routed to connection %d", prefix.String(), other.id)
+		}
+		table.routes[prefix] = conn
+	}
+	table.update_lengths()
+	fib.Store(table)
+	return nil
+}
+
+func fib_lookup(addr netip.Addr) (*Connection, bool) {
+	table := fib.Load()
+	for _, bits := range table.lengths {
+		if bits > addr.BitLen() { continue }
+		prefix, _ := addr.Prefix(bits)
+		conn, ok := table.routes[prefix]
+		if ok { return conn, true }
+	}
+	conn, ok := table.routes[DEFAULT_PREFIX]
+	return conn, ok
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// Run a test on an empty forwarding table and restore the previous one after
+func use_empty_fib(t *testing.T) {
+	old := fib.Load()
+	fib.Store(&fibTable{ routes: make(map[netip.Prefix]*Connection) })
+	t.Cleanup(func() { fib.Store(old) })
+}
+
+func TestFibLookup(t *testing.T) {
+	use_empty_fib(t)
+
+	conns := map[string]*Connection{}
+	for i, prefix := range []string{ "0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.3/32", "2001:db8::/32", "2001:db8::1/128" } {
+		conn := &Connection{ id: i + 1 }
+		conns[prefix] = conn
+		err := fib_replace(nil, []netip.Prefix{ netip.MustParsePrefix(prefix) }, conn)
+		if err != nil { t.Fatal(err) }
+	}
+
+	tests := []struct {
+		addr string
+		route string
+	}{
+		{ "10.1.2.3", "10.1.2.3/32" },
+		{ "10.1.2.4", "10.1.0.0/16" },
+		{ "10.2.0.1", "10.0.0.0/8" },
+		{ "192.0.2.1", "0.0.0.0/0" },
+		{ "2001:db8::1", "2001:db8::1/128" },
+		{ "2001:db8:1::1", "2001:db8::/32" },
+		{ "2001:db9::1", "0.0.0.0/0" },
+	}
+	for _, test := range tests {
+		conn, ok := fib_lookup(netip.MustParseAddr(test.addr))
+		if !ok || conn != conns[test.route] {
+			t.Errorf("fib_lookup(%s) did not match %s", test.addr, test.route)
+		}
+	}
+}
+
+func TestFibReplace(t *testing.T) {
+	use_empty_fib(t)
+
+	a := &Connection{ id: 1 }
+	b := &Connection{ id: 2 }
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+	addr := netip.MustParseAddr("10.0.0.1")
+
+	err := fib_replace(nil, []netip.Prefix{ prefix }, a)
+	if err != nil { t.Fatal(err) }
+	err = fib_replace(nil, []netip.Prefix{ netip.MustParsePrefix("10.0.0.7/24") }, b)
+	if err == nil { t.Fatal("Prefix routed to two connections") }
+
+	// removal by another connection keeps the route
+	err = fib_replace([]netip.Prefix{ prefix }, nil, b)
+	if err != nil { t.Fatal(err) }
+	if conn, ok := fib_lookup(addr); !ok || conn != a {
+		t.Fatal("Route removed by other connection")
+	}
+
+	// move in one update
+	err = fib_replace([]netip.Prefix{ prefix }, []netip.Prefix{ netip.MustParsePrefix("10.0.1.0/24") }, a)
+	if err != nil { t.Fatal(err) }
+	if _, ok := fib_lookup(addr); ok {
+		t.Fatal("Removed route still found")
+	}
+	if conn, ok := fib_lookup(netip.MustParseAddr("10.0.1.1")); !ok || conn != a {
+		t.Fatal("Added route not found")
+	}
+	if len(fib.Load().lengths) != 1 {
+		t.Fatalf("Prefix lengths %v not updated", fib.Load().lengths)
+	}
+}
@@ -7,7 +7,9 @@ replace github.com/quic-go/quic-go => github.com/uweber/quic-go v0.0.0-202312031
 require (
 	github.com/gaissmai/extnetip v0.3.3
 	github.com/quic-go/quic-go v0.40.0
+	github.com/vishvananda/netlink v1.3.0
 	github.com/vishvananda/netns v0.0.4
+	golang.org/x/crypto v0.14.0
 	golang.org/x/sys v0.13.0
 )
 
@@ -18,7 +20,6 @@ require (
 	github.com/quic-go/qpack v0.4.0 // indirect
 	github.com/quic-go/qtls-go1-20 v0.4.1 // indirect
 	go.uber.org/mock v0.3.0 // indirect
-	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/exp v0.0.0-20230725093048-515e97ebf090 // indirect
 	golang.org/x/mod v0.13.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
@@ -0,0 +1,207 @@
+//go:build server
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+Identity rules separated by ';', the first matching rule gives the username:
+  field [regex [template]]
+field is one of email, dns, uri, cn. The regex has to match the whole value.
+Without template the first group of the regex or the whole match is used,
+templates use $1 or ${name} references.
+
+Issuers in the allow and deny lists are separated by ';' and given either as
+sha256:<hex> hash of the issuer public key or as PEM file with issuer certificates.
+*/
+
+type identityRule struct {
+	field string
+	regex *regexp.Regexp
+	template string
+}
+
+type identityConfig struct {
+	rules[] identityRule
+	allow[] [sha256.Size]byte
+	deny[] [sha256.Size]byte
+}
+
+var identity atomic.Pointer[identityConfig]
+
+func parse_identity_rules(rules string) ([]identityRule, error) {
+	var result[] identityRule
+	for _, rule := range strings.Split(rules, ";") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 { continue }
+		if len(fields) > 3 { return nil, errors.New("Invalid identity rule "+rule) }
+
+		r := identityRule{ field: fields[0] }
+		switch r.field {
+		case "email", "dns", "uri", "cn":
+		default:
+			return nil, errors.New("Unknown certificate field "+r.field)
+		}
+		if len(fields) > 1 {
+			regex, err := regexp.Compile("^(?:"+fields[1]+")$")
+			if err != nil { return nil, err }
+			r.regex = regex
+			r.template = "$0"
+			if regex.NumSubexp() > 0 { r.template = "$1" }
+		}
+		if len(fields) > 2 {
+			r.template = fields[2]
+		}
+		result = append(result, r)
+	}
+	if len(result) == 0 { return nil, errors.New("No identity rule configured") }
+	return result, nil
+}
+
+func split_list(value string) []string {
+	var result[] string
+	for _, item := range strings.Split(value, ";") {
+		item = strings.TrimSpace(item)
+		if item != "" { result = append(result, item) }
+	}
+	return result
+}
+
+func spki_hash(cert *x509.Certificate) [sha256.Size]byte {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+func parse_issuers(value string) ([][sha256.Size]byte, error) {
+	var result[] [sha256.Size]byte
+	for _, item := range split_list(value) {
+		if pin, ok := strings.CutPrefix(item, "sha256:"); ok {
+			data, err := hex.DecodeString(pin)
+			if err != nil || len(data) != sha256.Size { return nil, errors.New("Invalid issuer key hash "+item) }
+			result = append(result, [sha256.Size]byte(data))
+			continue
+		}
+
+		data, err := os.ReadFile(item)
+		if err != nil { return nil, err }
+		count := 0
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil { break }
+			if block.Type != "CERTIFICATE" { continue }
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil { return nil, fmt.Errorf("Failed to parse issuer certificate in %s: %s", item, err.Error()) }
+			result = append(result, spki_hash(cert))
+			count++
+		}
+		if count == 0 { return nil, errors.New("No issuer certificate found in "+item) }
+	}
+	return result, nil
+}
+
+func load_identity_config(c *reloadConfig) (*identityConfig, error) {
+	rules, err := parse_identity_rules(c.tls_identity)
+	if err != nil { return nil, err }
+	allow, err := parse_issuers(c.tls_issuer_allow)
+	if err != nil { return nil, err }
+	deny, err := parse_issuers(c.tls_issuer_deny)
+	if err != nil { return nil, err }
+	return &identityConfig{ rules: rules, allow: allow, deny: deny }, nil
+}
+
+func identity_init() {
+	config, err := load_identity_config(rcfg())
+	if err != nil { log_fatal("Invalid client identity configuration: %s", err.Error()) }
+	identity.Store(config)
+}
+
+func get_cert_values(cert *x509.Certificate, field string) []string {
+	switch field {
+	case "email":
+		return cert.EmailAddresses
+	case "dns":
+		return cert.DNSNames
+	case "uri":
+		var uris[] string
+		for _, uri := range cert.URIs {
+			uris = append(uris, uri.String())
+		}
+		return uris
+	case "cn":
+		if cert.Subject.CommonName == "" { return nil }
+		return []string{ cert.Subject.CommonName }
+	}
+	return nil
+}
+
+// CA certificate of any verified chain whose public key is in issuers, so that
+// intermediates and roots match as well as the certificate that signed the client
+func chain_issuer(chains [][]*x509.Certificate, issuers [][sha256.Size]byte) *x509.Certificate {
+	for _, chain := range chains {
+		if len(chain) == 0 { continue }
+		for _, ca := range chain[1:] {
+			if slices.Contains(issuers, spki_hash(ca)) { return ca }
+		}
+	}
+	return nil
+}
+
+func (r *identityRule) apply(cert *x509.Certificate) string {
+	for _, value := range get_cert_values(cert, r.field) {
+		if r.regex == nil { return value }
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil { continue }
+		username := string(r.regex.ExpandString(nil, r.template, value, match))
+		if username != "" { return username }
+	}
+	return ""
+}
+
+// Issuer allow and deny lists, checked at the handshake whatever the request authenticates with
+func check_issuer(state *tls.ConnectionState) error {
+	config := identity.Load()
+	cert := state.PeerCertificates[0]
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) < 2 {
+		return errors.New("Certificate "+cert.Subject.String()+" without verified issuer")
+	}
+	if denied := chain_issuer(state.VerifiedChains, config.deny); denied != nil {
+		return errors.New("Certificate "+cert.Subject.String()+" from denied issuer "+denied.Subject.String())
+	}
+	if len(config.allow) > 0 && chain_issuer(state.VerifiedChains, config.allow) == nil {
+		return errors.New("Certificate "+cert.Subject.String()+" from issuer "+cert.Issuer.String()+" not allowed")
+	}
+	return nil
+}
+
+func GetTLSUser(state *tls.ConnectionState) string {
+	if (state == nil || len(state.PeerCertificates) == 0) {
+		return ""
+	}
+
+	err := check_issuer(state)
+	if err != nil {
+		log_info("Rejecting client: %s", err.Error())
+		return ""
+	}
+
+	config := identity.Load()
+	cert := state.PeerCertificates[0]
+	for _, rule := range config.rules {
+		username := rule.apply(cert)
+		if username != "" { return username }
+	}
+	log_info("No identity rule matches certificate %s", cert.Subject.String())
+	return ""
+}
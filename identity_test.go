@@ -0,0 +1,193 @@
+//go:build server
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func create_test_cert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parent_key *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil { t.Fatal(err) }
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parent_key = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parent_key)
+	if err != nil { t.Fatal(err) }
+	cert, err := x509.ParseCertificate(der)
+	if err != nil { t.Fatal(err) }
+	return cert, key
+}
+
+func create_test_ca(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return create_test_cert(t, &x509.Certificate{
+		Subject: pkix.Name{ CommonName: name },
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+}
+
+func TestParseIdentityRules(t *testing.T) {
+	tests := []struct {
+		rules string
+		count int
+		fails bool
+	}{
+		{ rules: "cn", count: 1 },
+		{ rules: "email ^(.*)@example.com$; dns; uri spiffe://example.com/(.*) vpn-$1", count: 3 },
+		{ rules: " ; cn ; ", count: 1 },
+		{ rules: "", fails: true },
+		{ rules: "serial", fails: true },
+		{ rules: "cn a b c", fails: true },
+		{ rules: "cn (unclosed", fails: true },
+	}
+	for _, test := range tests {
+		rules, err := parse_identity_rules(test.rules)
+		if test.fails {
+			if err == nil { t.Errorf("parse_identity_rules(%q) accepted", test.rules) }
+			continue
+		}
+		if err != nil || len(rules) != test.count {
+			t.Errorf("parse_identity_rules(%q) = %d rules, %v", test.rules, len(rules), err)
+		}
+	}
+}
+
+func TestIdentityRuleApply(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/user/alice")
+	cert := &x509.Certificate{
+		Subject: pkix.Name{ CommonName: "Alice Example" },
+		EmailAddresses: []string{ "alice@example.com", "alice@other.example" },
+		DNSNames: []string{ "alice.clients.example.com" },
+		URIs: []*url.URL{ spiffe },
+	}
+	tests := []struct {
+		rule string
+		user string
+	}{
+		{ "cn", "Alice Example" },
+		{ "email", "alice@example.com" },
+		{ "email (.*)@example\\.com", "alice" },
+		{ "email (?P<name>.*)@other\\.example ${name}-other", "alice-other" },
+		{ "dns ([^.]*)\\.clients\\.example\\.com", "alice" },
+		{ "uri spiffe://example\\.com/user/(.*) spiffe-$1", "spiffe-alice" },
+		// the regex has to match the whole value
+		{ "email alice", "" },
+		{ "email (.*)@example", "" },
+		{ "dns clients\\.example\\.com", "" },
+		{ "uri spiffe://example\\.com/", "" },
+		{ "cn Alice", "" },
+		{ "email a|alice@example\\.com", "alice@example.com" },
+	}
+	for _, test := range tests {
+		rules, err := parse_identity_rules(test.rule)
+		if err != nil { t.Fatal(err) }
+		user := rules[0].apply(cert)
+		if user != test.user {
+			t.Errorf("Rule %q gave %q, want %q", test.rule, user, test.user)
+		}
+	}
+}
+
+func TestGetTLSUser(t *testing.T) {
+	ca, ca_key := create_test_ca(t, "Test CA")
+	// same name, different key
+	fake, fake_key := create_test_ca(t, "Test CA")
+	client := &x509.Certificate{ Subject: pkix.Name{ CommonName: "alice" } }
+	cert, _ := create_test_cert(t, client, ca, ca_key)
+	fake_cert, _ := create_test_cert(t, client, fake, fake_key)
+
+	ca_file := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(ca_file, pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: ca.Raw }), 0600)
+	if err != nil { t.Fatal(err) }
+	ca_pin := spki_hash(ca)
+	pin := "sha256:" + hex.EncodeToString(ca_pin[:])
+
+	// alice2 is issued by an intermediate with chains to the CA and a cross-signing root
+	root, root_key := create_test_ca(t, "Test Root")
+	inter_template := &x509.Certificate{
+		Subject: pkix.Name{ CommonName: "Test Intermediate" },
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign,
+	}
+	inter, inter_key := create_test_cert(t, inter_template, ca, ca_key)
+	cross, _ := create_test_cert(t, inter_template, root, root_key)
+	inter_cert, _ := create_test_cert(t, &x509.Certificate{ Subject: pkix.Name{ CommonName: "alice2" } }, inter, inter_key)
+	root_pin := spki_hash(root)
+	inter_pin := spki_hash(inter)
+
+	verified := func(cert *x509.Certificate, issuer *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{ cert },
+			VerifiedChains: [][]*x509.Certificate{ { cert, issuer } },
+		}
+	}
+	chained := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{ inter_cert },
+		VerifiedChains: [][]*x509.Certificate{ { inter_cert, inter, ca }, { inter_cert, cross, root } },
+	}
+	tests := []struct {
+		name string
+		allow string
+		deny string
+		state *tls.ConnectionState
+		user string
+	}{
+		{ "no issuer lists", "", "", verified(cert, ca), "alice" },
+		{ "allowed by pin", pin, "", verified(cert, ca), "alice" },
+		{ "allowed by file", ca_file, "", verified(cert, ca), "alice" },
+		{ "same name other key", pin, "", verified(fake_cert, fake), "" },
+		{ "denied by pin", "", pin, verified(cert, ca), "" },
+		{ "denied by file", "", ca_file, verified(cert, ca), "" },
+		{ "deny other key", "", pin, verified(fake_cert, fake), "alice" },
+		{ "allowed intermediate", "sha256:" + hex.EncodeToString(inter_pin[:]), "", chained, "alice2" },
+		{ "allowed root", pin, "", chained, "alice2" },
+		{ "allowed root of other chain", "sha256:" + hex.EncodeToString(root_pin[:]), "", chained, "alice2" },
+		{ "denied root", "", pin, chained, "" },
+		{ "denied root of other chain", "", "sha256:" + hex.EncodeToString(root_pin[:]), chained, "" },
+		{ "denied intermediate", "", "sha256:" + hex.EncodeToString(inter_pin[:]), chained, "" },
+		{ "unverified", pin, "", &tls.ConnectionState{ PeerCertificates: []*x509.Certificate{ cert } }, "" },
+		{ "no certificate", "", "", &tls.ConnectionState{}, "" },
+	}
+	for _, test := range tests {
+		config, err := load_identity_config(&reloadConfig{ tls_identity: "cn", tls_issuer_allow: test.allow, tls_issuer_deny: test.deny })
+		if err != nil { t.Fatal(err) }
+		identity.Store(config)
+		user := GetTLSUser(test.state)
+		if user != test.user {
+			t.Errorf("%s: got user %q, want %q", test.name, user, test.user)
+		}
+		// the handshake applies the issuer lists as well, for bearer tokens on mutual TLS
+		if len(test.state.VerifiedChains) == 0 { continue }
+		err = verify_connection(*test.state)
+		if (err == nil) != (test.user != "") {
+			t.Errorf("%s: handshake verification returned %v", test.name, err)
+		}
+	}
+	identity.Store(nil)
+}
+
+func TestParseIssuers(t *testing.T) {
+	tests := []string{ "sha256:abcd", "sha256:" + hex.EncodeToString(make([]byte, 33)), "CN=Test CA", "/nonexistent/ca.pem" }
+	for _, value := range tests {
+		_, err := parse_issuers(value)
+		if err == nil { t.Errorf("parse_issuers(%q) accepted", value) }
+	}
+}
@@ -1,33 +1,122 @@
 package main
 
 import (
+	"errors"
 	"net/netip"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/gaissmai/extnetip"
 )
 
+// Single address or delegated prefix handed out to a client
 type ipam_addr struct {
-	ipaddr netip.Addr
+	prefix netip.Prefix
 	time time.Time
 	used bool
+	user string
+	retired bool
 }
 
-var ipam struct {
-	network netip.Prefix
+type ipamPool struct {
+	networks[] netip.Prefix
 	pool[] ipam_addr
+	lock sync.Mutex
+	released chan struct{}
+}
+
+func (h *vhost) ipam_init(prefixes string) []netip.Prefix {
+	networks, pool, err := ipam_build(prefixes, rcfg())
+	if err != nil { panic(err) }
+	h.ipam.networks = networks
+	h.ipam.pool = pool
+
+	h.ipam.released = make(chan struct{})
+	h.ipam_load_leases()
+	return h.ipam.networks
+}
+
+func ipam_build(prefixes string, c *reloadConfig) ([]netip.Prefix, []ipam_addr, error) {
+	var networks[] netip.Prefix
+	var pool[] ipam_addr
+	for _, field := range strings.Fields(prefixes) {
+		network, err := netip.ParsePrefix(field)
+		if err != nil { return nil, nil, err }
+		pool, err = ipam_add_network(pool, network, c)
+		if err != nil { return nil, nil, err }
+		networks = append(networks, network)
+	}
+	if len(networks) == 0 {
+		return nil, nil, errors.New("No IP address pool configured")
+	}
+	return networks, pool, nil
+}
+
+// Replace the pool keeping leases, addresses in use from removed networks stay until freed
+func (h *vhost) ipam_reload(networks []netip.Prefix, pool []ipam_addr) {
+	h.ipam.lock.Lock()
+	defer h.ipam.lock.Unlock()
+
+	old := map[netip.Prefix]ipam_addr{}
+	for _, entry := range h.ipam.pool {
+		old[entry.prefix] = entry
+	}
+	for i := range pool {
+		entry, ok := old[pool[i].prefix]
+		if !ok { continue }
+		pool[i] = entry
+		delete(old, entry.prefix)
+	}
+	for _, entry := range old {
+		if !entry.used { continue }
+		entry.retired = true
+		pool = append(pool, entry)
+	}
+
+	h.ipam.networks = networks
+	h.ipam.pool = pool
+	h.ipam_save_leases()
+	close(h.ipam.released)
+	h.ipam.released = make(chan struct{})
 }
 
-func ipam_init(prefix string) netip.Prefix {
-	network := netip.MustParsePrefix(prefix)
+// Networks of the pool, replaced as a whole by a reload
+func (h *vhost) ipam_networks() []netip.Prefix {
+	h.ipam.lock.Lock()
+	defer h.ipam.lock.Unlock()
+	return h.ipam.networks
+}
+
+// Families served by the pool, IPv4 first
+func (h *vhost) ipam_families() []netip.Addr {
+	networks := h.ipam_networks()
+	var families[] netip.Addr
+	for _, family := range []netip.Addr{ netip.IPv4Unspecified(), netip.IPv6Unspecified() } {
+		for _, network := range networks {
+			if network.Addr().Is4() == family.Is4() {
+				families = append(families, family)
+				break
+			}
+		}
+	}
+	return families
+}
+
+func ipam_add_network(pool []ipam_addr, network netip.Prefix, c *reloadConfig) ([]ipam_addr, error) {
+	if network.Addr().Is6() && c.delegate_length < 128 {
+		return ipam_add_delegated(pool, network, c.delegate_length, c.max_pool_size)
+	}
 
 	max := 0
 	if network.Addr().Is4() {
 		if network.Bits() > 30 {
-			panic("IPv4 network size must be at least /30")
+			return nil, errors.New("IPv4 network size must be at least /30")
 		}
 		max = (1 << (32 - network.Bits())) - 3
 	} else if network.Addr().Is6() {
 		if network.Bits() > 126 {
-			panic("IPv6 network size must be at least /126")
+			return nil, errors.New("IPv6 network size must be at least /126")
 		}
 		if network.Bits() > 96 {
 			max = (1 << (128 - network.Bits())) - 3
@@ -36,48 +125,223 @@ func ipam_init(prefix string) netip.Prefix {
 		}
 	}
 
-	if max > cfg.max_pool_size {
-		max = cfg.max_pool_size
+	if max > c.max_pool_size {
+		max = c.max_pool_size
 	}
 
 	// Start leases from beginning and skip network address
 	base := network.Masked().Addr()
 	base = base.Next()
 
-	ipam.pool = nil
+	count := 0
 	for i := 0; i < max; i++ {
 		base = base.Next()
 		if base.Compare(network.Addr()) == 0 {
 			base = base.Next()
 		}
-		ipam.pool = append(ipam.pool, ipam_addr{ ipaddr: base })
+		pool = append(pool, ipam_addr{ prefix: netip.PrefixFrom(base, base.BitLen()) })
+		count++
 	}
 
-	ipam.network = network
-	log_info("Initalized IP address pool %s with %d addresses", ipam.network.String(), len(ipam.pool))
-	return ipam.network
+	log_info("Initalized IP address pool %s with %d addresses", network.String(), count)
+	return pool, nil
+}
+
+// Carve network into prefixes of given length, skipping the local address
+func ipam_add_delegated(pool []ipam_addr, network netip.Prefix, bits int, max int) ([]ipam_addr, error) {
+	if bits < network.Bits() {
+		return nil, errors.New("Delegated prefix length must not be shorter than the pool")
+	}
+
+	count := 0
+	prefix := netip.PrefixFrom(network.Masked().Addr(), bits)
+	for count < max && network.Contains(prefix.Addr()) {
+		if !prefix.Contains(network.Addr()) {
+			pool = append(pool, ipam_addr{ prefix: prefix })
+			count++
+		}
+		_, last := extnetip.Range(prefix)
+		if !last.Next().IsValid() { break }
+		prefix = netip.PrefixFrom(last.Next(), bits)
+	}
+
+	log_info("Initalized IP prefix pool %s with %d /%d prefixes", network.String(), count, bits)
+	return pool, nil
+}
+
+// Static address of another user
+func (h *vhost) reserved_for_other(a *ipam_addr, user string) bool {
+	owner := h.get_address_user(a.prefix)
+	return owner != "" && owner != user
+}
+
+// Lease is kept for the last user until lease_time after release, unless the pool runs out
+func (h *vhost) leased_to_other(a *ipam_addr, user string) bool {
+	owner := h.get_address_user(a.prefix)
+	if owner != "" { return owner != user }
+	if a.user == "" || a.user == user { return false }
+	return time.Since(a.time) < time.Duration(rcfg().lease_time) * time.Second
+}
+
+func (h *vhost) ipam_take(i int, user string) netip.Prefix {
+	h.ipam.pool[i].time = time.Now()
+	h.ipam.pool[i].used = true
+	h.ipam.pool[i].user = user
+	h.ipam_save_leases()
+	return h.ipam.pool[i].prefix
 }
 
-func ipam_get(want netip.Addr) *netip.Addr {
-	for i := 0; i < len(ipam.pool); i++  {
-		if (ipam.pool[i].used || ipam.pool[i].ipaddr.Is4() != want.Is4()) {
+// Grant static reservation, requested address, previous lease or any free address
+// Part of a delegated prefix with the requested length, a request may ask for a longer
+// prefix than delegate_length with or without an address, a host length asks for none
+func ipam_requested_length(prefix netip.Prefix, want netip.Prefix) netip.Prefix {
+	bits := want.Bits()
+	if !prefix.IsValid() || bits <= prefix.Bits() || bits >= want.Addr().BitLen() { return prefix }
+	if want.Addr().IsUnspecified() { return netip.PrefixFrom(prefix.Addr(), bits) }
+	if prefix.Contains(want.Addr()) { return want.Masked() }
+	return prefix
+}
+
+func (h *vhost) ipam_get(want netip.Prefix, user string) netip.Prefix {
+	return ipam_requested_length(h.ipam_get_prefix(want, user), want)
+}
+
+func (h *vhost) ipam_get_prefix(want netip.Prefix, user string) netip.Prefix {
+	h.ipam.lock.Lock()
+	defer h.ipam.lock.Unlock()
+
+	static := h.get_user_address(user, want.Addr().Is4())
+	if static.IsValid() {
+		for i := 0; i < len(h.ipam.pool); i++  {
+			if !h.ipam.pool[i].prefix.Contains(static) { continue }
+			if !h.ipam.pool[i].used {
+				log_debug("Using static address %s for %s", static.String(), user)
+				return h.ipam_take(i, user)
+			}
+			log_warn("Static address %s for %s already in use", static.String(), user)
+		}
+	}
+
+	if !want.Addr().IsUnspecified() {
+		for i := 0; i < len(h.ipam.pool); i++  {
+			if (h.ipam.pool[i].used || !want.Overlaps(h.ipam.pool[i].prefix)) {
+				continue
+			}
+			if h.leased_to_other(&h.ipam.pool[i], user) { continue }
+			log_debug("Granting requested address %s for %s", h.ipam.pool[i].prefix.String(), want.String())
+			return h.ipam_take(i, user)
+		}
+		log_info("Requested address %s not available", want.String())
+	}
+
+	if user != "" {
+		for i := 0; i < len(h.ipam.pool); i++  {
+			if (h.ipam.pool[i].used || h.ipam.pool[i].user != user || h.ipam.pool[i].prefix.Addr().Is4() != want.Addr().Is4()) {
+				continue
+			}
+			if h.get_address_user(h.ipam.pool[i].prefix) != "" { continue }
+			log_debug("Renewing lease %s for %s", h.ipam.pool[i].prefix.String(), user)
+			return h.ipam_take(i, user)
+		}
+	}
+
+	// never leased addresses first, then the oldest expired or released lease
+	oldest := -1
+	for i := 0; i < len(h.ipam.pool); i++  {
+		if (h.ipam.pool[i].used || h.ipam.pool[i].prefix.Addr().Is4() != want.Addr().Is4()) {
 			continue
 		}
-		ipam.pool[i].time = time.Now()
-		ipam.pool[i].used = true
-		return &ipam.pool[i].ipaddr;
+		if h.reserved_for_other(&h.ipam.pool[i], user) { continue }
+		if h.ipam.pool[i].user == "" { return h.ipam_take(i, user) }
+		if oldest < 0 || h.ipam.pool[i].time.Before(h.ipam.pool[oldest].time) { oldest = i }
+	}
+	if oldest >= 0 {
+		if h.leased_to_other(&h.ipam.pool[oldest], user) {
+			log_info("Reclaiming lease %s of %s for %s", h.ipam.pool[oldest].prefix.String(), h.ipam.pool[oldest].user, user)
+		}
+		return h.ipam_take(oldest, user)
 	}
 	log_err("Cant find free IP address for %s", want.String())
-	return nil
+	return netip.Prefix{}
 }
 
-func ipam_free(ipaddr *netip.Addr) {
-	if ipaddr == nil { return }
-	for i := 0; i < len(ipam.pool); i++  {
-		if ipaddr.Compare(ipam.pool[i].ipaddr) == 0 {
-			ipam.pool[i].used = false
+func (h *vhost) ipam_available(user string) int {
+	h.ipam.lock.Lock()
+	defer h.ipam.lock.Unlock()
+
+	free := 0
+	for i := 0; i < len(h.ipam.pool); i++  {
+		if h.ipam.pool[i].used || h.reserved_for_other(&h.ipam.pool[i], user) { continue }
+		free++
+	}
+	return free
+}
+
+// Get an address and apply the pool exhaustion policy if none is free
+func (h *vhost) ipam_acquire(want netip.Prefix, user string) netip.Prefix {
+	h.ipam.lock.Lock()
+	released := h.ipam.released
+	h.ipam.lock.Unlock()
+
+	addr := h.ipam_get(want, user)
+	if addr.IsValid() { return addr }
+	stats.pool_exhausted.Add(1)
+
+	switch rcfg().pool_exhausted {
+	case "queue":
+		log_info("Address pool exhausted, queueing request for %s", want.String())
+	case "evict":
+		if !evict_idle_connection(h, want.Addr().Is4()) { return addr }
+	default:
+		return addr
+	}
+
+	timeout := time.After(time.Duration(rcfg().pool_queue_timeout) * time.Second)
+	for {
+		select {
+		case <-released:
+		case <-timeout:
+			log_err("Timeout waiting for free IP address for %s", want.String())
+			return addr
+		}
+
+		h.ipam.lock.Lock()
+		released = h.ipam.released
+		h.ipam.lock.Unlock()
+
+		addr = h.ipam_get(want, user)
+		if addr.IsValid() { return addr }
+	}
+}
+
+func (h *vhost) ipam_usage() (int, int) {
+	h.ipam.lock.Lock()
+	defer h.ipam.lock.Unlock()
+
+	used := 0
+	for i := 0; i < len(h.ipam.pool); i++  {
+		if h.ipam.pool[i].used { used++ }
+	}
+	return len(h.ipam.pool), used
+}
+
+func (h *vhost) ipam_free(prefix netip.Prefix) {
+	h.ipam.lock.Lock()
+	defer h.ipam.lock.Unlock()
+
+	for i := 0; i < len(h.ipam.pool); i++  {
+		// the client may use only a part of the delegated prefix
+		if h.ipam.pool[i].prefix.Contains(prefix.Addr()) {
+			h.ipam.pool[i].used = false
+			h.ipam.pool[i].time = time.Now()
+			if h.ipam.pool[i].retired {
+				h.ipam.pool = append(h.ipam.pool[:i], h.ipam.pool[i+1:]...)
+			}
+			h.ipam_save_leases()
+			close(h.ipam.released)
+			h.ipam.released = make(chan struct{})
 			return
 		}
 	}
-	log_err("Cant find IP %s to free", ipaddr.String())
+	log_err("Cant find IP %s to free", prefix.String())
 }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func use_reload_config(t *testing.T, c reloadConfig) {
+	old := reloaded.Load()
+	reloaded.Store(&c)
+	t.Cleanup(func() { reloaded.Store(old) })
+}
+
+func new_test_host(t *testing.T, pool string, users map[string]*userEntry) *vhost {
+	use_reload_config(t, reloadConfig{ max_pool_size: 1000, delegate_length: 128, lease_time: 3600, pool_exhausted: "reject" })
+	h := &vhost{ name: "test", users: users }
+	h.ipam_init(pool)
+	return h
+}
+
+func TestIpamBuild(t *testing.T) {
+	tests := []struct {
+		pool string
+		delegate int
+		max int
+		size int
+		first string
+		fails bool
+	}{
+		{ pool: "10.0.0.1/29", delegate: 128, max: 1000, size: 5, first: "10.0.0.2/32" },
+		{ pool: "10.0.0.1/30", delegate: 128, max: 1000, size: 1, first: "10.0.0.2/32" },
+		{ pool: "10.0.0.1/24", delegate: 128, max: 10, size: 10, first: "10.0.0.2/32" },
+		{ pool: "2001:db8::1/120", delegate: 128, max: 1000, size: 253, first: "2001:db8::2/128" },
+		{ pool: "10.0.0.1/24 2001:db8::1/120", delegate: 128, max: 1000, size: 253 + 253, first: "10.0.0.2/32" },
+		{ pool: "2001:db8::1/56", delegate: 64, max: 1000, size: 255, first: "2001:db8:0:1::/64" },
+		{ pool: "2001:db8::1/56", delegate: 64, max: 16, size: 16, first: "2001:db8:0:1::/64" },
+		{ pool: "10.0.0.1/31", delegate: 128, max: 1000, fails: true },
+		{ pool: "2001:db8::1/127", delegate: 128, max: 1000, fails: true },
+		{ pool: "2001:db8::1/64", delegate: 48, max: 1000, fails: true },
+		{ pool: "10.0.0.1", delegate: 128, max: 1000, fails: true },
+		{ pool: "", delegate: 128, max: 1000, fails: true },
+	}
+	for _, test := range tests {
+		networks, pool, err := ipam_build(test.pool, &reloadConfig{ delegate_length: test.delegate, max_pool_size: test.max })
+		if test.fails {
+			if err == nil { t.Errorf("ipam_build(%q) accepted", test.pool) }
+			continue
+		}
+		if err != nil {
+			t.Errorf("ipam_build(%q) failed: %s", test.pool, err.Error())
+			continue
+		}
+		if len(pool) != test.size || pool[0].prefix.String() != test.first {
+			t.Errorf("ipam_build(%q) = %d entries starting with %s, want %d starting with %s", test.pool, len(pool), pool[0].prefix, test.size, test.first)
+		}
+		for _, entry := range pool {
+			for _, network := range networks {
+				if entry.prefix.Contains(network.Addr()) {
+					t.Errorf("ipam_build(%q) hands out local address %s", test.pool, network.Addr())
+				}
+			}
+		}
+	}
+}
+
+func TestIpamExhausted(t *testing.T) {
+	any4 := netip.PrefixFrom(netip.IPv4Unspecified(), 32)
+	h := new_test_host(t, "10.0.0.1/30", nil)
+
+	first := h.ipam_get(any4, "")
+	if first.String() != "10.0.0.2/32" {
+		t.Fatalf("Got %s from fresh pool", first)
+	}
+	if got := h.ipam_get(any4, ""); got.IsValid() {
+		t.Fatalf("Got %s from exhausted pool", got)
+	}
+	h.ipam_free(first)
+	if got := h.ipam_get(any4, ""); got != first {
+		t.Errorf("Got %s after free, want %s", got, first)
+	}
+}
+
+func TestIpamGet(t *testing.T) {
+	users := map[string]*userEntry{ "static": { addresses: []netip.Addr{ netip.MustParseAddr("10.0.0.5") } } }
+	any4 := netip.PrefixFrom(netip.IPv4Unspecified(), 32)
+	p := netip.MustParsePrefix
+
+	// steps run in order on one pool of 10.0.0.2 - 10.0.0.6
+	tests := []struct {
+		name string
+		user string
+		free string
+		got string
+	}{
+		{ name: "static reservation", user: "static", got: "10.0.0.5/32" },
+		{ name: "first lease", user: "alice", got: "10.0.0.2/32" },
+		{ name: "second lease", user: "bob", got: "10.0.0.3/32" },
+		{ name: "renew lease", user: "alice", free: "10.0.0.2/32", got: "10.0.0.2/32" },
+		{ name: "never leased first", user: "carol", free: "10.0.0.2/32", got: "10.0.0.4/32" },
+		{ name: "lease kept for last user", user: "dave", got: "10.0.0.6/32" },
+		{ name: "reclaim oldest lease", user: "erin", got: "10.0.0.2/32" },
+		{ name: "exhausted", user: "frank", got: "invalid Prefix" },
+	}
+
+	h := new_test_host(t, "10.0.0.1/29", users)
+	for _, test := range tests {
+		if test.free != "" { h.ipam_free(p(test.free)) }
+		got := h.ipam_get(any4, test.user)
+		if got.String() != test.got {
+			t.Fatalf("%s: got %s, want %s", test.name, got, test.got)
+		}
+	}
+
+	// a freed static reservation is only handed to its user
+	h.ipam_free(p("10.0.0.5/32"))
+	if got := h.ipam_get(any4, "frank"); got.IsValid() {
+		t.Errorf("Static address handed to other user: %s", got)
+	}
+	if available := h.ipam_available("static"); available != 1 {
+		t.Errorf("Available for static user %d, want 1", available)
+	}
+}
+
+func TestLeaseDatabase(t *testing.T) {
+	dir := t.TempDir()
+	any4 := netip.PrefixFrom(netip.IPv4Unspecified(), 32)
+	h := new_test_host(t, "10.0.0.1/29", nil)
+	h.leases_file = filepath.Join(dir, "leases.db")
+	h.ipam_get(any4, "alice")
+	h.ipam_get(any4, "bob")
+	h.ipam_free(netip.MustParsePrefix("10.0.0.3/32"))
+
+	use_reload_config(t, reloadConfig{ max_pool_size: 1000, delegate_length: 64, lease_time: 3600 })
+	h6 := &vhost{ name: "test6" }
+	h6.ipam_init("2001:db8::1/56")
+	h6.leases_file = filepath.Join(dir, "leases6.db")
+	h6.ipam_get(netip.MustParsePrefix("2001:db8:0:7::/64"), "carol")
+
+	tests := []struct {
+		file string
+		pool string
+		delegate int
+		user string
+		lease string
+	}{
+		{ h.leases_file, "10.0.0.1/29", 128, "alice", "10.0.0.2/32" },
+		{ h.leases_file, "10.0.0.1/29", 128, "bob", "10.0.0.3/32" },
+		{ h6.leases_file, "2001:db8::1/56", 64, "carol", "2001:db8:0:7::/64" },
+	}
+	for _, test := range tests {
+		use_reload_config(t, reloadConfig{ max_pool_size: 1000, delegate_length: test.delegate, lease_time: 3600 })
+		loaded := &vhost{ name: "loaded", leases_file: test.file }
+		loaded.ipam_init(test.pool)
+
+		var lease *ipam_addr
+		for i := range loaded.ipam.pool {
+			if loaded.ipam.pool[i].user == test.user { lease = &loaded.ipam.pool[i] }
+		}
+		if lease == nil || lease.prefix.String() != test.lease || lease.used || time.Since(lease.time) > time.Minute {
+			t.Errorf("Lease %s of %s not loaded from %s: %v", test.lease, test.user, test.file, lease)
+		}
+	}
+}
+
+func TestIpamGetRequested(t *testing.T) {
+	p := netip.MustParsePrefix
+
+	// steps run in order on one pool of 10.0.0.2 - 10.0.0.6
+	tests := []struct {
+		name string
+		user string
+		want netip.Prefix
+		free string
+		got string
+	}{
+		{ name: "requested address", user: "alice", want: p("10.0.0.3/32"), got: "10.0.0.3/32" },
+		{ name: "requested address in use", user: "bob", want: p("10.0.0.3/32"), got: "10.0.0.2/32" },
+		{ name: "requested address leased to other", user: "bob", want: p("10.0.0.3/32"), free: "10.0.0.3/32", got: "10.0.0.4/32" },
+		{ name: "requested own lease", user: "alice", want: p("10.0.0.3/32"), got: "10.0.0.3/32" },
+		{ name: "requested address outside pool", user: "carol", want: p("192.0.2.1/32"), got: "10.0.0.5/32" },
+	}
+
+	h := new_test_host(t, "10.0.0.1/29", nil)
+	for _, test := range tests {
+		if test.free != "" { h.ipam_free(p(test.free)) }
+		got := h.ipam_get(test.want, test.user)
+		if got.String() != test.got {
+			t.Fatalf("%s: got %s, want %s", test.name, got, test.got)
+		}
+	}
+}
+
+func TestIpamDualStack(t *testing.T) {
+	any4 := netip.PrefixFrom(netip.IPv4Unspecified(), 32)
+	any6 := netip.PrefixFrom(netip.IPv6Unspecified(), 128)
+
+	h := new_test_host(t, "10.0.0.1/30 2001:db8::1/126", nil)
+	if got := h.ipam_get(any4, "alice"); got.String() != "10.0.0.2/32" {
+		t.Errorf("Got IPv4 address %s", got)
+	}
+	if got := h.ipam_get(any6, "alice"); got.String() != "2001:db8::2/128" {
+		t.Errorf("Got IPv6 address %s", got)
+	}
+
+	h4 := new_test_host(t, "10.0.0.1/30", nil)
+	if got := h4.ipam_get(any6, "alice"); got.IsValid() {
+		t.Errorf("Got IPv6 address %s without IPv6 pool", got)
+	}
+}
+
+func TestIpamReload(t *testing.T) {
+	h := new_test_host(t, "10.0.0.1/29", nil)
+	used := h.ipam_get(netip.MustParsePrefix("10.0.0.6/32"), "alice")
+	kept := h.ipam_get(netip.MustParsePrefix("10.0.0.2/32"), "bob")
+
+	networks, pool, err := ipam_build("10.0.0.1/30 10.1.0.1/30", rcfg())
+	if err != nil { t.Fatal(err) }
+	h.ipam_reload(networks, pool)
+
+	size, in_use := h.ipam_usage()
+	if size != 3 || in_use != 2 {
+		t.Fatalf("Pool of %d with %d in use after reload, want 3 with 2", size, in_use)
+	}
+	// addresses of removed networks are dropped once freed
+	h.ipam_free(used)
+	h.ipam_free(kept)
+	size, in_use = h.ipam_usage()
+	if size != 2 || in_use != 0 {
+		t.Fatalf("Pool of %d with %d in use after free, want 2 with 0", size, in_use)
+	}
+	if got := h.ipam_get(netip.PrefixFrom(netip.IPv4Unspecified(), 32), "bob"); got != kept {
+		t.Errorf("Lease of bob not kept over reload: %s", got)
+	}
+}
+
+func TestIpamRequestedLength(t *testing.T) {
+	p := netip.MustParsePrefix
+	use_reload_config(t, reloadConfig{ max_pool_size: 1000, delegate_length: 48, lease_time: 3600 })
+	h := &vhost{ name: "test" }
+	h.ipam_init("2001:db8::1/40")
+
+	tests := []struct {
+		name string
+		want netip.Prefix
+		got string
+	}{
+		{ name: "length without address", want: p("::/56"), got: "2001:db8:1::/56" },
+		{ name: "length shorter than delegated", want: p("::/40"), got: "2001:db8:2::/48" },
+		{ name: "host length", want: p("::/128"), got: "2001:db8:3::/48" },
+		{ name: "address and length", want: p("2001:db8:4:100::/56"), got: "2001:db8:4:100::/56" },
+	}
+	for _, test := range tests {
+		got := h.ipam_get(test.want, "")
+		if got.String() != test.got {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.got)
+		}
+	}
+
+	h.ipam_free(p("2001:db8:1::/56"))
+	if _, in_use := h.ipam_usage(); in_use != 3 {
+		t.Errorf("%d prefixes in use after free, want 3", in_use)
+	}
+}
@@ -0,0 +1,356 @@
+//go:build server
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const JWT_LEEWAY = 60 * time.Second
+const JWKS_REFRESH = 1 * time.Hour
+const JWKS_MIN_REFRESH = 1 * time.Minute
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N string `json:"n"`
+	E string `json:"e"`
+	Crv string `json:"crv"`
+	X string `json:"x"`
+	Y string `json:"y"`
+}
+
+type jwtKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+var jwks struct {
+	keys[] jwtKey
+	loaded time.Time
+	lock sync.Mutex
+	refresh sync.Once
+}
+
+var b64url = base64.RawURLEncoding
+
+func decode_bigint(value string) (*big.Int, error) {
+	b, err := b64url.DecodeString(value)
+	if err != nil { return nil, err }
+	return new(big.Int).SetBytes(b), nil
+}
+
+func parse_jwk(k jwk) (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decode_bigint(k.N)
+		if err != nil { return nil, err }
+		e, err := decode_bigint(k.E)
+		if err != nil { return nil, err }
+		if !e.IsInt64() { return nil, errors.New("Invalid RSA exponent") }
+		return &rsa.PublicKey{ N: n, E: int(e.Int64()) }, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("Unsupported curve "+k.Crv)
+		}
+		x, err := decode_bigint(k.X)
+		if err != nil { return nil, err }
+		y, err := decode_bigint(k.Y)
+		if err != nil { return nil, err }
+		if !curve.IsOnCurve(x, y) { return nil, errors.New("Point not on curve") }
+		return &ecdsa.PublicKey{ Curve: curve, X: x, Y: y }, nil
+	case "OKP":
+		if k.Crv != "Ed25519" { return nil, errors.New("Unsupported curve "+k.Crv) }
+		x, err := b64url.DecodeString(k.X)
+		if err != nil { return nil, err }
+		if len(x) != ed25519.PublicKeySize { return nil, errors.New("Invalid Ed25519 key size") }
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("Unsupported key type "+k.Kty)
+}
+
+func read_jwks(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "https://") && !strings.HasPrefix(source, "http://") {
+		return os.ReadFile(source)
+	}
+
+	client := http.Client{ Timeout: 10 * time.Second }
+	rsp, err := client.Get(source)
+	if err != nil { return nil, err }
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request failed: %s", rsp.Status)
+	}
+	return io.ReadAll(io.LimitReader(rsp.Body, 1 << 20))
+}
+
+func load_jwks(source string) ([]jwtKey, error) {
+	data, err := read_jwks(source)
+	if err != nil { return nil, err }
+
+	var set struct {
+		Keys[] jwk `json:"keys"`
+	}
+	err = json.Unmarshal(data, &set)
+	if err != nil { return nil, err }
+
+	var keys[] jwtKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" { continue }
+		key, err := parse_jwk(k)
+		if err != nil {
+			log_warn("Ignoring JWK %s: %s", k.Kid, err.Error())
+			continue
+		}
+		keys = append(keys, jwtKey{ kid: k.Kid, alg: k.Alg, key: key })
+	}
+	if len(keys) == 0 { return nil, errors.New("No usable signing keys in "+source) }
+	return keys, nil
+}
+
+func jwks_init() {
+	if rcfg().jwt_jwks == "" { return }
+
+	err := jwks_refresh(true)
+	if err != nil { log_fatal("Failed to load JWKS %s: %s", rcfg().jwt_jwks, err.Error()) }
+	jwks_start_refresh()
+}
+
+// Periodic refresh, also started when a reload enables the JWKS
+func jwks_start_refresh() {
+	jwks.refresh.Do(func() {
+		go func() {
+			for {
+				time.Sleep(JWKS_REFRESH)
+				if rcfg().jwt_jwks == "" { continue }
+				err := jwks_refresh(true)
+				if err != nil { log_err("Failed to refresh JWKS %s: %s", rcfg().jwt_jwks, err.Error()) }
+			}
+		}()
+	})
+}
+
+// Refresh keeps the old keys on failure, unforced refreshes are rate limited.
+// The fetch runs without the lock so verifications with known keys are not blocked.
+func jwks_refresh(force bool) error {
+	jwks.lock.Lock()
+	if !force && time.Since(jwks.loaded) < JWKS_MIN_REFRESH {
+		jwks.lock.Unlock()
+		return nil
+	}
+	jwks.loaded = time.Now()
+	jwks.lock.Unlock()
+
+	source := rcfg().jwt_jwks
+	keys, err := load_jwks(source)
+	if err != nil { return err }
+
+	jwks.lock.Lock()
+	jwks.keys = keys
+	jwks.lock.Unlock()
+	log_info("Loaded %d keys from JWKS %s", len(keys), source)
+	return nil
+}
+
+func jwks_find(kid string) []jwtKey {
+	jwks.lock.Lock()
+	defer jwks.lock.Unlock()
+
+	var keys[] jwtKey
+	for _, key := range jwks.keys {
+		if kid == "" || key.kid == kid {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func get_jwt_hash(alg string) crypto.Hash {
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256
+	case "384":
+		return crypto.SHA384
+	case "512":
+		return crypto.SHA512
+	}
+	return 0
+}
+
+func verify_jwt_signature(alg string, key crypto.PublicKey, data []byte, sig []byte) bool {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, data, sig)
+	}
+	if len(alg) != 5 { return false }
+
+	hash := get_jwt_hash(alg)
+	if hash == 0 { return false }
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(pub, hash, digest, sig, nil) == nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok { return false }
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2 * size { return false }
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// Audience and groups claims may be a string or a list of strings
+func get_claim_list(value any) []string {
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var list[] string
+		for _, item := range v {
+			s, ok := item.(string)
+			if ok { list = append(list, s) }
+		}
+		return list
+	}
+	return nil
+}
+
+func get_claim_time(claims map[string]any, name string) (time.Time, bool) {
+	value, ok := claims[name].(float64)
+	if !ok { return time.Time{}, false }
+	return time.Unix(int64(value), 0), true
+}
+
+// Validate a JWT and return username and groups
+func verify_jwt(token string) (string, []string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 { return "", nil, errors.New("Malformed token") }
+
+	var header jwtHeader
+	data, err := b64url.DecodeString(parts[0])
+	if err != nil { return "", nil, err }
+	err = json.Unmarshal(data, &header)
+	if err != nil { return "", nil, err }
+	if header.Alg == "none" || strings.HasPrefix(header.Alg, "HS") {
+		return "", nil, errors.New("Unsupported algorithm "+header.Alg)
+	}
+
+	sig, err := b64url.DecodeString(parts[2])
+	if err != nil { return "", nil, err }
+
+	keys := jwks_find(header.Kid)
+	if len(keys) == 0 {
+		// key rotation, try again with fresh keys
+		err = jwks_refresh(false)
+		if err != nil { log_err("Failed to refresh JWKS %s: %s", rcfg().jwt_jwks, err.Error()) }
+		keys = jwks_find(header.Kid)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	valid := false
+	for _, key := range keys {
+		if key.alg != "" && key.alg != header.Alg { continue }
+		if verify_jwt_signature(header.Alg, key.key, signed, sig) {
+			valid = true
+			break
+		}
+	}
+	if !valid { return "", nil, errors.New("Invalid signature") }
+
+	claims := map[string]any{}
+	data, err = b64url.DecodeString(parts[1])
+	if err != nil { return "", nil, err }
+	err = json.Unmarshal(data, &claims)
+	if err != nil { return "", nil, err }
+
+	now := time.Now()
+	exp, ok := get_claim_time(claims, "exp")
+	if !ok || now.After(exp.Add(JWT_LEEWAY)) { return "", nil, errors.New("Token expired") }
+	nbf, ok := get_claim_time(claims, "nbf")
+	if ok && now.Add(JWT_LEEWAY).Before(nbf) { return "", nil, errors.New("Token not yet valid") }
+
+	if rcfg().jwt_issuer != "" && claims["iss"] != rcfg().jwt_issuer {
+		return "", nil, fmt.Errorf("Invalid issuer %v", claims["iss"])
+	}
+	if rcfg().jwt_audience != "" && !slices.Contains(get_claim_list(claims["aud"]), rcfg().jwt_audience) {
+		return "", nil, fmt.Errorf("Invalid audience %v", claims["aud"])
+	}
+
+	username, ok := claims[rcfg().jwt_user_claim].(string)
+	if !ok || username == "" { return "", nil, errors.New("Missing claim "+rcfg().jwt_user_claim) }
+	return username, get_claim_list(claims[rcfg().jwt_groups_claim]), nil
+}
+
+// User must be in one of the allowed groups if configured
+func jwt_groups_allowed(groups []string) bool {
+	allowed := strings.Fields(rcfg().jwt_groups)
+	if len(allowed) == 0 { return true }
+	for _, group := range groups {
+		if slices.Contains(allowed, group) { return true }
+	}
+	return false
+}
+
+func is_bearer(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Username and groups of a valid token from an allowed group
+func bearer_auth(r *http.Request) (string, []string) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	username, groups, err := verify_jwt(strings.TrimSpace(token))
+	if err != nil {
+		log_fields("remote", r.RemoteAddr).info("Invalid bearer token from %s: %s", r.RemoteAddr, err.Error())
+		stats.auth_failures.Add(1)
+		return "", nil
+	}
+	if !jwt_groups_allowed(groups) {
+		log_fields("user", username, "remote", r.RemoteAddr).info("User %s from %s not in allowed groups", username, r.RemoteAddr)
+		stats.auth_failures.Add(1)
+		return "", nil
+	}
+	return username, groups
+}
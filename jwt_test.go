@@ -0,0 +1,223 @@
+//go:build server
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type jwtSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func (s *jwtSigner) jwk() map[string]string {
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{ "kty": "RSA", "kid": s.kid, "alg": s.alg,
+			"n": b64url.EncodeToString(pub.N.Bytes()), "e": b64url.EncodeToString(big.NewInt(int64(pub.E)).Bytes()) }
+	case *ecdsa.PublicKey:
+		return map[string]string{ "kty": "EC", "kid": s.kid, "crv": "P-256",
+			"x": b64url.EncodeToString(pub.X.FillBytes(make([]byte, 32))), "y": b64url.EncodeToString(pub.Y.FillBytes(make([]byte, 32))) }
+	case ed25519.PublicKey:
+		return map[string]string{ "kty": "OKP", "kid": s.kid, "crv": "Ed25519", "x": b64url.EncodeToString(pub) }
+	}
+	panic("Unsupported key")
+}
+
+func (s *jwtSigner) sign(t *testing.T, header map[string]any, claims map[string]any) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := b64url.EncodeToString(h) + "." + b64url.EncodeToString(c)
+
+	var sig[] byte
+	var err error
+	digest := sha256.Sum256([]byte(signed))
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		if err == nil { sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...) }
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil { t.Fatal(err) }
+	return signed + "." + b64url.EncodeToString(sig)
+}
+
+// Serve keys of signers from a JWKS file with the given token requirements
+func setup_jwks(t *testing.T, signers []*jwtSigner, c reloadConfig) {
+	var keys[] map[string]string
+	for _, signer := range signers {
+		keys = append(keys, signer.jwk())
+	}
+	data, _ := json.Marshal(map[string]any{ "keys": keys })
+	c.jwt_jwks = filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(c.jwt_jwks, data, 0600)
+	if err != nil { t.Fatal(err) }
+
+	old := reloaded.Load()
+	reloaded.Store(&c)
+	t.Cleanup(func() { reloaded.Store(old) })
+
+	loaded, err := load_jwks(c.jwt_jwks)
+	if err != nil { t.Fatal(err) }
+	jwks.lock.Lock()
+	jwks.keys = loaded
+	jwks.loaded = time.Now()
+	jwks.lock.Unlock()
+}
+
+func TestVerifyJwt(t *testing.T) {
+	rsa_key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ec_key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, ed_key, _ := ed25519.GenerateKey(rand.Reader)
+	_, other_key, _ := ed25519.GenerateKey(rand.Reader)
+	rs := &jwtSigner{ kid: "rsa", alg: "RS256", key: rsa_key }
+	es := &jwtSigner{ kid: "ec", alg: "ES256", key: ec_key }
+	ed := &jwtSigner{ kid: "ed", alg: "EdDSA", key: ed_key }
+	other := &jwtSigner{ kid: "ed", alg: "EdDSA", key: other_key }
+
+	setup_jwks(t, []*jwtSigner{ rs, es, ed }, reloadConfig{
+		jwt_issuer: "https://issuer.example",
+		jwt_audience: "h3tunnel",
+		jwt_user_claim: "sub",
+		jwt_groups_claim: "groups",
+	})
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{ "iss": "https://issuer.example", "aud": []string{ "h3tunnel", "other" },
+			"sub": "user1", "groups": []string{ "vpn", "staff" }, "exp": now + 300 }
+		for key, value := range changes {
+			if value == nil {
+				delete(c, key)
+			} else {
+				c[key] = value
+			}
+		}
+		return c
+	}
+	header := func(signer *jwtSigner) map[string]any {
+		return map[string]any{ "alg": signer.alg, "kid": signer.kid }
+	}
+
+	tests := []struct {
+		name string
+		token string
+		user string
+	}{
+		{ "RS256", rs.sign(t, header(rs), claims(nil)), "user1" },
+		{ "ES256", es.sign(t, header(es), claims(nil)), "user1" },
+		{ "EdDSA", ed.sign(t, header(ed), claims(nil)), "user1" },
+		{ "without kid", ed.sign(t, map[string]any{ "alg": "EdDSA" }, claims(nil)), "user1" },
+		{ "audience string", ed.sign(t, header(ed), claims(map[string]any{ "aud": "h3tunnel" })), "user1" },
+		{ "within leeway", ed.sign(t, header(ed), claims(map[string]any{ "exp": now - 30 })), "user1" },
+		{ "unknown key", other.sign(t, header(other), claims(nil)), "" },
+		{ "algorithm of other key", es.sign(t, map[string]any{ "alg": "ES256", "kid": "rsa" }, claims(nil)), "" },
+		{ "alg none", ed.sign(t, map[string]any{ "alg": "none", "kid": "ed" }, claims(nil)), "" },
+		{ "alg HS256", ed.sign(t, map[string]any{ "alg": "HS256", "kid": "ed" }, claims(nil)), "" },
+		{ "expired", ed.sign(t, header(ed), claims(map[string]any{ "exp": now - 300 })), "" },
+		{ "without exp", ed.sign(t, header(ed), claims(map[string]any{ "exp": nil })), "" },
+		{ "not yet valid", ed.sign(t, header(ed), claims(map[string]any{ "nbf": now + 300 })), "" },
+		{ "wrong issuer", ed.sign(t, header(ed), claims(map[string]any{ "iss": "https://other.example" })), "" },
+		{ "wrong audience", ed.sign(t, header(ed), claims(map[string]any{ "aud": "other" })), "" },
+		{ "without subject", ed.sign(t, header(ed), claims(map[string]any{ "sub": nil })), "" },
+		{ "malformed", "a.b", "" },
+	}
+	for _, test := range tests {
+		user, groups, err := verify_jwt(test.token)
+		if test.user == "" {
+			if err == nil { t.Errorf("%s: token accepted for %s", test.name, user) }
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if user != test.user || !slices.Equal(groups, []string{ "vpn", "staff" }) {
+			t.Errorf("%s: got %s %v", test.name, user, groups)
+		}
+	}
+
+	// a modified payload breaks the signature
+	token := ed.sign(t, header(ed), claims(nil))
+	forged := ed.sign(t, header(ed), claims(map[string]any{ "sub": "admin" }))
+	parts, forged_parts := strings.Split(token, "."), strings.Split(forged, ".")
+	_, _, err := verify_jwt(parts[0] + "." + forged_parts[1] + "." + parts[2])
+	if err == nil { t.Error("Token with modified payload accepted") }
+}
+
+func TestJwtGroupsAllowed(t *testing.T) {
+	tests := []struct {
+		allowed string
+		groups[] string
+		result bool
+	}{
+		{ "", nil, true },
+		{ "vpn", []string{ "staff", "vpn" }, true },
+		{ "vpn admin", []string{ "admin" }, true },
+		{ "vpn", []string{ "staff" }, false },
+		{ "vpn", nil, false },
+	}
+	for _, test := range tests {
+		c := reloadConfig{ jwt_groups: test.allowed }
+		old := reloaded.Load()
+		reloaded.Store(&c)
+		result := jwt_groups_allowed(test.groups)
+		reloaded.Store(old)
+		if result != test.result {
+			t.Errorf("jwt_groups_allowed(%v) with %q = %v, want %v", test.groups, test.allowed, result, test.result)
+		}
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer := &jwtSigner{ kid: "ed", alg: "EdDSA", key: key }
+	setup_jwks(t, []*jwtSigner{ signer }, reloadConfig{
+		jwt_user_claim: "sub",
+		jwt_groups_claim: "groups",
+		jwt_groups: "vpn",
+	})
+
+	tests := []struct {
+		groups[] string
+		user string
+	}{
+		{ []string{ "staff", "vpn" }, "user1" },
+		{ []string{ "staff" }, "" },
+	}
+	for _, test := range tests {
+		token := signer.sign(t, map[string]any{ "alg": "EdDSA", "kid": "ed" },
+			map[string]any{ "sub": "user1", "groups": test.groups, "exp": time.Now().Unix() + 300 })
+		r := httptest.NewRequest("CONNECT", "https://vpn.example/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		// groups are kept for policy and accounting of the session
+		user, groups := bearer_auth(r)
+		if user != test.user {
+			t.Errorf("Groups %v authenticated as %q, want %q", test.groups, user, test.user)
+		}
+		if user != "" && !slices.Equal(groups, test.groups) {
+			t.Errorf("Groups %v returned as %v", test.groups, groups)
+		}
+	}
+}
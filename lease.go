@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Lease database, one line per user:
+  user: address|prefix unixtime [address|prefix unixtime]...
+*/
+
+func (h *vhost) ipam_load_leases() {
+	filename := h.leases_file
+	if filename == "" { return }
+
+	leases := 0
+	for user, value := range read_config(filename, false) {
+		fields := strings.Fields(value)
+		if len(fields) % 2 != 0 {
+			log_err("Invalid lease for %s: %s", user, value)
+			continue
+		}
+		for ; len(fields) > 0; fields = fields[2:] {
+			prefix, err := parse_lease_prefix(fields[0])
+			if err != nil {
+				log_err("Invalid lease address for %s: %s", user, err.Error())
+				continue
+			}
+			since, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				log_err("Invalid lease time for %s: %s", user, err.Error())
+				continue
+			}
+
+			for i := 0; i < len(h.ipam.pool); i++ {
+				if h.ipam.pool[i].prefix != prefix { continue }
+				h.ipam.pool[i].user = user
+				h.ipam.pool[i].time = time.Unix(since, 0)
+				leases++
+			}
+		}
+	}
+	log_info("Loaded %d address leases from %s", leases, filename)
+}
+
+func parse_lease_prefix(lease string) (netip.Prefix, error) {
+	if strings.Contains(lease, "/") {
+		return netip.ParsePrefix(lease)
+	}
+	addr, err := netip.ParseAddr(lease)
+	if err != nil { return netip.Prefix{}, err }
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Must be called with ipam lock held
+func (h *vhost) ipam_save_leases() {
+	filename := h.leases_file
+	if filename == "" { return }
+
+	tmpfile := filename + ".tmp"
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		log_err("Cant write lease database %s: %s", tmpfile, err.Error())
+		return
+	}
+
+	leases := map[string]string{}
+	var users[] string
+	for i := 0; i < len(h.ipam.pool); i++ {
+		lease := &h.ipam.pool[i]
+		if lease.user == "" { continue }
+		if !lease.used && time.Since(lease.time) > time.Duration(rcfg().lease_time) * time.Second {
+			continue
+		}
+		if _, ok := leases[lease.user]; !ok {
+			users = append(users, lease.user)
+		}
+		address := lease.prefix.String()
+		if lease.prefix.IsSingleIP() {
+			address = lease.prefix.Addr().String()
+		}
+		leases[lease.user] += fmt.Sprintf(" %s %d", address, lease.time.Unix())
+	}
+	for _, user := range users {
+		fmt.Fprintf(f, "%s:%s\n", user, leases[user])
+	}
+
+	err = f.Close()
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		log_err("Cant write lease database %s: %s", filename, err.Error())
+	}
+}
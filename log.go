@@ -1,6 +1,15 @@
 package main
 
-import "log"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+)
 
 const (
 	LOG_ERROR = 3
@@ -9,34 +18,197 @@ const (
 	LOG_DEBUG = 7
 )
 
+const JOURNALD_SOCKET = "/run/systemd/journal/socket"
+
 var MAX_LOGLEVEL = LOG_INFO
 
-func mylog(severity int, format string, v ...any) {
-	if severity > MAX_LOGLEVEL {
-		return
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+var log_level = &slog.LevelVar{}
+
+// Key/value fields attached to log messages of a session
+type logFields []any
+
+func get_slog_level(severity int) slog.Level {
+	switch {
+	case severity <= LOG_ERROR:
+		return slog.LevelError
+	case severity <= LOG_WARNING:
+		return slog.LevelWarn
+	case severity <= LOG_INFO:
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug
+}
+
+func get_severity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return LOG_ERROR
+	case level >= slog.LevelWarn:
+		return LOG_WARNING
+	case level >= slog.LevelInfo:
+		return LOG_INFO
 	}
+	return LOG_DEBUG
+}
+
+// Handler for sinks taking one formatted message with severity
+type sinkHandler struct {
+	attrs[] slog.Attr
+	send func(severity int, msg string, attrs []slog.Attr) error
+}
+
+func (h *sinkHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= log_level.Level()
+}
+
+func (h *sinkHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := append([]slog.Attr{}, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return h.send(get_severity(r.Level), r.Message, attrs)
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sinkHandler{ attrs: append(append([]slog.Attr{}, h.attrs...), attrs...), send: h.send }
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+func new_syslog_handler() (slog.Handler, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON, BUILD_NAME)
+	if err != nil { return nil, err }
+
+	send := func(severity int, msg string, attrs []slog.Attr) error {
+		for _, a := range attrs {
+			msg += " " + a.String()
+		}
+		switch severity {
+		case LOG_ERROR:
+			return w.Err(msg)
+		case LOG_WARNING:
+			return w.Warning(msg)
+		case LOG_INFO:
+			return w.Info(msg)
+		}
+		return w.Debug(msg)
+	}
+	return &sinkHandler{ send: send }, nil
+}
+
+// Field names must be upper case letters, digits and underscores
+func get_journald_field(key string) string {
+	field := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' { return r - 'a' + 'A' }
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') { return r }
+		return '_'
+	}, key)
+	return strings.TrimLeft(field, "_")
+}
+
+// Native journal protocol, multi line values are not used
+func new_journald_handler() (slog.Handler, error) {
+	conn, err := net.Dial("unixgram", JOURNALD_SOCKET)
+	if err != nil { return nil, err }
+
+	send := func(severity int, msg string, attrs []slog.Attr) error {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "PRIORITY=%d\nSYSLOG_IDENTIFIER=%s\nMESSAGE=%s\n", severity, BUILD_NAME, strings.ReplaceAll(msg, "\n", " "))
+		for _, a := range attrs {
+			field := get_journald_field(a.Key)
+			if field == "" { continue }
+			fmt.Fprintf(&b, "%s=%s\n", field, strings.ReplaceAll(a.Value.String(), "\n", " "))
+		}
+		_, err := conn.Write(b.Bytes())
+		return err
+	}
+	return &sinkHandler{ send: send }, nil
+}
+
+func log_init() {
+	log_level.Set(get_slog_level(MAX_LOGLEVEL))
+	opts := &slog.HandlerOptions{ Level: log_level }
+
+	if cfg.log_format != "text" && cfg.log_format != "json" {
+		log_fatal("Invalid log format %s", cfg.log_format)
+	}
+
+	var handler slog.Handler
+	var err error
+	switch cfg.log_target {
+	case "stderr":
+		if cfg.log_format == "json" {
+			handler = slog.NewJSONHandler(os.Stderr, opts)
+		} else {
+			handler = slog.NewTextHandler(os.Stderr, opts)
+		}
+	case "syslog":
+		handler, err = new_syslog_handler()
+	case "journald":
+		handler, err = new_journald_handler()
+	default:
+		log_fatal("Invalid log target %s", cfg.log_target)
+	}
+	if err != nil { log_fatal("Cant open %s log: %s", cfg.log_target, err.Error()) }
+
+	logger = slog.New(handler)
 	if cfg.log_prefix != "" {
-		format = cfg.log_prefix + " " + format
+		logger = logger.With("prefix", cfg.log_prefix)
+	}
+}
+
+func mylog(severity int, fields logFields, format string, v ...any) {
+	if severity > MAX_LOGLEVEL {
+		return
 	}
-	log.Printf(format, v...)
+	logger.Log(context.Background(), get_slog_level(severity), fmt.Sprintf(format, v...), fields...)
 }
 
 func log_err(format string, v ...any) {
-	mylog(LOG_ERROR, format, v...)
+	mylog(LOG_ERROR, nil, format, v...)
 }
 
 func log_warn(format string, v ...any) {
-	mylog(LOG_WARNING, format, v...)
+	mylog(LOG_WARNING, nil, format, v...)
 }
 
 func log_info(format string, v ...any) {
-	mylog(LOG_INFO, format, v...)
+	mylog(LOG_INFO, nil, format, v...)
 }
 
 func log_debug(format string, v ...any) {
-	mylog(LOG_DEBUG, format, v...)
+	mylog(LOG_DEBUG, nil, format, v...)
 }
 
 func log_fatal(format string, v ...any) {
-	log.Fatalf(format, v...)
+	mylog(LOG_ERROR, nil, format, v...)
+	os.Exit(1)
+}
+
+func log_fields(args ...any) logFields {
+	return logFields(args)
+}
+
+func (f logFields) with(args ...any) logFields {
+	return append(append(logFields{}, f...), args...)
+}
+
+func (f logFields) err(format string, v ...any) {
+	mylog(LOG_ERROR, f, format, v...)
+}
+
+func (f logFields) warn(format string, v ...any) {
+	mylog(LOG_WARNING, f, format, v...)
+}
+
+func (f logFields) info(format string, v ...any) {
+	mylog(LOG_INFO, f, format, v...)
+}
+
+func (f logFields) debug(format string, v ...any) {
+	mylog(LOG_DEBUG, f, format, v...)
 }
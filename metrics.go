@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func write_metric(w io.Writer, name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func write_traffic(w io.Writer, prefix string, label string, traffic map[string]*trafficStats, keys []string) {
+	values := []struct{ name string; help string; get func(*trafficStats) int }{
+		{ "rx_bytes_total", "Bytes received from tunnel peers", func(t *trafficStats) int { return t.rx_bytes } },
+		{ "tx_bytes_total", "Bytes sent to tunnel peers", func(t *trafficStats) int { return t.tx_bytes } },
+		{ "rx_packets_total", "Packets received from tunnel peers", func(t *trafficStats) int { return t.rx_packets } },
+		{ "tx_packets_total", "Packets sent to tunnel peers", func(t *trafficStats) int { return t.tx_packets } },
+	}
+
+	for _, value := range values {
+		name := prefix + value.name
+		write_metric(w, name, "counter", value.help)
+		for _, key := range keys {
+			if label == "" {
+				fmt.Fprintf(w, "%s %d\n", name, value.get(traffic[key]))
+			} else {
+				fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, label_escaper.Replace(key), value.get(traffic[key]))
+			}
+		}
+	}
+}
+
+// Prometheus text exposition format
+func write_metrics(w io.Writer) {
+	users := map[string]*trafficStats{}
+	sessions := 0
+
+	// closed sessions move to the totals under the connection lock
+	connection_sync.RLock()
+	stats.lock.Lock()
+	total := stats.total
+	for user, traffic := range stats.users {
+		users[user] = &trafficStats{}
+		*users[user] = *traffic
+	}
+	stats.lock.Unlock()
+
+	for _, conn := range connections {
+		if conn.is_local() { continue }
+		sessions++
+		total.add(conn)
+		if conn.user == "" { continue }
+		if users[conn.user] == nil {
+			users[conn.user] = &trafficStats{}
+		}
+		users[conn.user].add(conn)
+	}
+	connection_sync.RUnlock()
+
+	var names[] string
+	for user := range users {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+
+	write_traffic(w, "h3tunnel_", "", map[string]*trafficStats{ "": &total }, []string{ "" })
+	write_traffic(w, "h3tunnel_user_", "user", users, names)
+
+	write_metric(w, "h3tunnel_sessions", "gauge", "Active tunnel sessions")
+	fmt.Fprintf(w, "h3tunnel_sessions %d\n", sessions)
+
+	write_metric(w, "h3tunnel_dropped_packets_total", "counter", "Dropped packets by reason")
+	drops := []struct{ reason string; value int64 }{
+		{ "short_packet", stats.drop_short.Load() },
+		{ "invalid_version", stats.drop_invalid.Load() },
+		{ "spoofed", stats.drop_spoofed.Load() },
+		{ "out_of_scope", stats.drop_scope.Load() },
+		{ "no_route", stats.drop_no_route.Load() },
+		{ "send_error", stats.drop_send_error.Load() },
+	}
+	for _, drop := range drops {
+		fmt.Fprintf(w, "h3tunnel_dropped_packets_total{reason=\"%s\"} %d\n", drop.reason, drop.value)
+	}
+
+	write_metric(w, "h3tunnel_auth_failures_total", "counter", "Failed authentication attempts")
+	fmt.Fprintf(w, "h3tunnel_auth_failures_total %d\n", stats.auth_failures.Load())
+	write_metric(w, "h3tunnel_pool_exhausted_total", "counter", "Address requests that found the pool exhausted")
+	fmt.Fprintf(w, "h3tunnel_pool_exhausted_total %d\n", stats.pool_exhausted.Load())
+	write_metric(w, "h3tunnel_evicted_total", "counter", "Idle sessions evicted for a new session")
+	fmt.Fprintf(w, "h3tunnel_evicted_total %d\n", stats.evicted.Load())
+
+	size, used := 0, 0
+	for _, host := range all_hosts() {
+		host_size, host_used := host.ipam_usage()
+		size += host_size
+		used += host_used
+	}
+	if size > 0 {
+		write_metric(w, "h3tunnel_pool_size", "gauge", "Addresses and prefixes in the pool")
+		fmt.Fprintf(w, "h3tunnel_pool_size %d\n", size)
+		write_metric(w, "h3tunnel_pool_used", "gauge", "Addresses and prefixes in use")
+		fmt.Fprintf(w, "h3tunnel_pool_used %d\n", used)
+	}
+
+	h := &stats.handshake
+	h.lock.Lock()
+	write_metric(w, "h3tunnel_handshake_seconds", "histogram", "Time to establish a tunnel session")
+	for i, bound := range HANDSHAKE_BUCKETS {
+		var count uint64
+		if h.buckets != nil {
+			count = h.buckets[i]
+		}
+		fmt.Fprintf(w, "h3tunnel_handshake_seconds_bucket{le=\"%g\"} %d\n", bound, count)
+	}
+	fmt.Fprintf(w, "h3tunnel_handshake_seconds_bucket{le=\"+Inf\"} %d\n", h.count)
+	fmt.Fprintf(w, "h3tunnel_handshake_seconds_sum %g\n", h.sum)
+	fmt.Fprintf(w, "h3tunnel_handshake_seconds_count %d\n", h.count)
+	h.lock.Unlock()
+}
+
+func metrics_init(listen string) {
+	if listen == "" { return }
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		write_metrics(w)
+	})
+
+	go func() {
+		err := http.ListenAndServe(listen, handler)
+		if err != nil { log_err("Metrics listener on %s failed: %s", listen, err.Error()) }
+	}()
+	log_info("Metrics listening on %s", listen)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	TABLE_MAIN = 254
+	TABLE_VPN = 100
+	RULE_PRIO = 10000
+)
+
+// Policy routing rule, sport 0 matches any port and suppress_prefixlen -1 disables suppression
+type netRule struct {
+	is6 bool
+	priority int
+	table int
+	iif string
+	sport int
+	invert bool
+	suppress_prefixlen int
+}
+
+// Network configuration backend for links, addresses, routes and rules
+type netBackend interface {
+	link_up(dev string, mtu int) error
+	link_netns(dev string, netns string) error
+	addr_add(dev string, prefix netip.Prefix) error
+	addr_del(dev string, prefix netip.Prefix) error
+	route(mode string, dev string, prefix netip.Prefix, table int) error
+	rule(mode string, rule netRule) error
+}
+
+type NetError struct {
+	Op string
+	Target string
+	Err error
+}
+
+var ErrNetNotFound = errors.New("object not found")
+var ErrNetExists = errors.New("object exists")
+
+func (e *NetError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Op, e.Target, e.Err.Error())
+}
+
+func (e *NetError) Unwrap() error {
+	return e.Err
+}
+
+func is_not_found(err error) bool {
+	return errors.Is(err, ErrNetNotFound) || errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENOENT)
+}
+
+func is_exists(err error) bool {
+	return errors.Is(err, ErrNetExists) || errors.Is(err, unix.EEXIST)
+}
+
+var net_backend_once sync.Once
+var net_backend_impl netBackend
+
+func net_backend() netBackend {
+	net_backend_once.Do(func() {
+		switch cfg.net_backend {
+		case "iproute2":
+			net_backend_impl = &iproute2Backend{}
+		case "netlink":
+			backend, err := new_netlink_backend(cfg.netns)
+			if err != nil { log_fatal("Failed to open netlink: %s", err.Error()) }
+			net_backend_impl = backend
+		default:
+			log_fatal("Unknown network backend %s", cfg.net_backend)
+		}
+		log_debug("Using %s network backend", cfg.net_backend)
+	})
+	return net_backend_impl
+}
+
+func setup_ip(dev string, ipaddr netip.Prefix) error {
+	log_info("Setting IP address %s on dev %s", ipaddr.String(), dev)
+	backend := net_backend()
+	err := backend.link_up(dev, cfg.mtu)
+	if err != nil { return err }
+	return backend.addr_add(dev, ipaddr)
+}
+
+func remove_ip(dev string, ipaddr netip.Prefix) error {
+	log_info("Removing IP address %s from dev %s", ipaddr.String(), dev)
+	return net_backend().addr_del(dev, ipaddr)
+}
+
+var route_map_name = map[string]string {"add": "Installing", "del": "Removing"}
+var route_map_family = map[bool]string {true: "inet6", false: "inet"}
+
+func setup_default_route(mode string, dev string, prefix netip.Prefix, udp_port int) error {
+	is6 := prefix.Addr().Is6()
+	backend := net_backend()
+
+	log_info("%s default %s route on dev %s in table %d", route_map_name[mode], route_map_family[is6], dev, TABLE_VPN)
+
+	rules := []netRule{
+		// route local generated VPN traffic from local port
+		{ is6: is6, priority: RULE_PRIO, table: TABLE_MAIN, iif: "lo", sport: udp_port, suppress_prefixlen: -1 },
+		// route direct attached networks, but skip default route
+		{ is6: is6, priority: RULE_PRIO + 1, table: TABLE_MAIN, suppress_prefixlen: 0 },
+		// route default traffic via VPN
+		{ is6: is6, priority: RULE_PRIO + 2, table: TABLE_VPN, iif: "lo", sport: udp_port, invert: true, suppress_prefixlen: -1 },
+	}
+
+	// try all steps and report the first failure, rules left over from a previous run are kept
+	var result error
+	for _, rule := range rules {
+		err := backend.rule(mode, rule)
+		if err == nil || (mode == "add" && is_exists(err)) { continue }
+		if result == nil { result = err }
+	}
+
+	err := backend.route(mode, dev, prefix.Masked(), TABLE_VPN)
+	if mode == "add" && is_exists(err) { err = nil }
+	if result == nil { result = err }
+	return result
+}
+
+func setup_route(mode string, dev string, prefix netip.Prefix, udp_port int) error {
+	if prefix.Bits() == 0 {
+		return setup_default_route(mode, dev, prefix, udp_port)
+	}
+
+	log_info("%s route %s/%d on dev %s", route_map_name[mode], prefix.Addr().String(), prefix.Bits(), dev)
+	return net_backend().route(mode, dev, prefix.Masked(), TABLE_MAIN)
+}
+
+// Remove route, a route already gone is not an error
+func remove_route(dev string, prefix netip.Prefix, udp_port int) {
+	err := setup_route("del", dev, prefix, udp_port)
+	if err != nil && !is_not_found(err) {
+		log_err("Failed to remove route %s: %s", prefix.String(), err.Error())
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// Fallback backend running the iproute2 ip command
+type iproute2Backend struct {}
+
+func run_cmd(format string, a ...any) error {
+	cmd_line := fmt.Sprintf(format, a...)
+	args := strings.Fields(cmd_line)
+	cmd := exec.Command(args[0], args[1:]...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(output))
+		err = &NetError{ Op: args[0], Target: cmd_line, Err: fmt.Errorf("%s: %s", err.Error(), msg) }
+		if strings.Contains(msg, "No such process") || strings.Contains(msg, "No such file") {
+			err = &NetError{ Op: args[0], Target: cmd_line, Err: ErrNetNotFound }
+		}
+		if strings.Contains(msg, "File exists") {
+			err = &NetError{ Op: args[0], Target: cmd_line, Err: ErrNetExists }
+		}
+		return err
+	}
+	log_debug("Executed command: %s", cmd_line)
+	return nil
+}
+
+func run_cmd_netns(format string, a ...any) error {
+	if cfg.netns != "" {
+		format = fmt.Sprintf("ip netns exec %s %s", cfg.netns, format)
+	}
+	return run_cmd(format, a...)
+}
+
+func (b *iproute2Backend) link_up(dev string, mtu int) error {
+	err := run_cmd_netns("ip link set dev %s mtu %d", dev, mtu)
+	if err != nil { return err }
+	return run_cmd_netns("ip link set dev %s up", dev)
+}
+
+func (b *iproute2Backend) link_netns(dev string, netns string) error {
+	return run_cmd("ip link set %s netns %s", dev, netns)
+}
+
+func (b *iproute2Backend) addr_add(dev string, prefix netip.Prefix) error {
+	return run_cmd_netns("ip addr add %s dev %s", prefix.String(), dev)
+}
+
+func (b *iproute2Backend) addr_del(dev string, prefix netip.Prefix) error {
+	return run_cmd_netns("ip addr del %s dev %s", prefix.String(), dev)
+}
+
+func (b *iproute2Backend) route(mode string, dev string, prefix netip.Prefix, table int) error {
+	family := route_map_family[prefix.Addr().Is6()]
+	return run_cmd_netns("ip -f %s route %s %s table %d dev %s", family, mode, prefix.String(), table, dev)
+}
+
+func (b *iproute2Backend) rule(mode string, r netRule) error {
+	args := fmt.Sprintf("ip -f %s rule %s pri %d table %d", route_map_family[r.is6], mode, r.priority, r.table)
+	if r.invert {
+		args += " not"
+	}
+	if r.iif != "" {
+		args += " iif " + r.iif
+	}
+	if r.sport != 0 {
+		args += fmt.Sprintf(" ipproto udp sport %d", r.sport)
+	}
+	if r.suppress_prefixlen >= 0 {
+		args += fmt.Sprintf(" suppress_prefixlength %d", r.suppress_prefixlen)
+	}
+	return run_cmd_netns(args)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+type netlinkBackend struct {
+	handle *netlink.Handle
+}
+
+// Handle operates inside netns, links are created in the current one
+func new_netlink_backend(namespace string) (*netlinkBackend, error) {
+	if namespace == "" {
+		handle, err := netlink.NewHandle()
+		if err != nil { return nil, err }
+		return &netlinkBackend{ handle: handle }, nil
+	}
+
+	ns, err := netns.GetFromName(namespace)
+	if err != nil { return nil, err }
+	defer ns.Close()
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil { return nil, err }
+	return &netlinkBackend{ handle: handle }, nil
+}
+
+func get_ipnet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP: prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
+
+func get_netlink_family(is6 bool) int {
+	if is6 { return unix.AF_INET6 }
+	return unix.AF_INET
+}
+
+func (b *netlinkBackend) link(op string, dev string) (netlink.Link, error) {
+	link, err := b.handle.LinkByName(dev)
+	if err != nil { return nil, &NetError{ Op: op, Target: dev, Err: err } }
+	return link, nil
+}
+
+func (b *netlinkBackend) link_up(dev string, mtu int) error {
+	link, err := b.link("link set", dev)
+	if err != nil { return err }
+
+	err = b.handle.LinkSetMTU(link, mtu)
+	if err != nil { return &NetError{ Op: "link set mtu", Target: dev, Err: err } }
+	err = b.handle.LinkSetUp(link)
+	if err != nil { return &NetError{ Op: "link set up", Target: dev, Err: err } }
+	return nil
+}
+
+func (b *netlinkBackend) link_netns(dev string, namespace string) error {
+	link, err := netlink.LinkByName(dev)
+	if err != nil { return &NetError{ Op: "link set netns", Target: dev, Err: err } }
+
+	ns, err := netns.GetFromName(namespace)
+	if err != nil { return &NetError{ Op: "link set netns", Target: namespace, Err: err } }
+	defer ns.Close()
+
+	err = netlink.LinkSetNsFd(link, int(ns))
+	if err != nil { return &NetError{ Op: "link set netns", Target: dev, Err: err } }
+	return nil
+}
+
+func (b *netlinkBackend) addr_add(dev string, prefix netip.Prefix) error {
+	link, err := b.link("addr add", dev)
+	if err != nil { return err }
+
+	err = b.handle.AddrAdd(link, &netlink.Addr{ IPNet: get_ipnet(prefix) })
+	if err != nil { return &NetError{ Op: "addr add", Target: prefix.String(), Err: err } }
+	return nil
+}
+
+func (b *netlinkBackend) addr_del(dev string, prefix netip.Prefix) error {
+	link, err := b.link("addr del", dev)
+	if err != nil { return err }
+
+	err = b.handle.AddrDel(link, &netlink.Addr{ IPNet: get_ipnet(prefix) })
+	if err != nil { return &NetError{ Op: "addr del", Target: prefix.String(), Err: err } }
+	return nil
+}
+
+func (b *netlinkBackend) route(mode string, dev string, prefix netip.Prefix, table int) error {
+	op := "route " + mode
+	link, err := b.link(op, dev)
+	if err != nil { return err }
+
+	route := netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst: get_ipnet(prefix),
+		Table: table,
+	}
+	if mode == "add" {
+		err = b.handle.RouteAdd(&route)
+	} else {
+		err = b.handle.RouteDel(&route)
+	}
+	if err != nil { return &NetError{ Op: op, Target: prefix.String(), Err: err } }
+	return nil
+}
+
+func (b *netlinkBackend) rule(mode string, r netRule) error {
+	rule := netlink.NewRule()
+	rule.Family = get_netlink_family(r.is6)
+	rule.Priority = r.priority
+	rule.Table = r.table
+	rule.IifName = r.iif
+	rule.Invert = r.invert
+	rule.SuppressPrefixlen = r.suppress_prefixlen
+	if r.sport != 0 {
+		rule.IPProto = unix.IPPROTO_UDP
+		rule.Sport = netlink.NewRulePortRange(uint16(r.sport), uint16(r.sport))
+	}
+
+	var err error
+	if mode == "add" {
+		err = b.handle.RuleAdd(rule)
+	} else {
+		err = b.handle.RuleDel(rule)
+	}
+	if err != nil { return &NetError{ Op: "rule " + mode, Target: rule.String(), Err: err } }
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// Records network changes instead of applying them, calls listed in fail return their error
+type fakeBackend struct {
+	lock sync.Mutex
+	calls[] string
+	fail map[string]error
+	check func(call string)
+}
+
+func (b *fakeBackend) record(call string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.check != nil { b.check(call) }
+	b.calls = append(b.calls, call)
+	return b.fail[call]
+}
+
+func (b *fakeBackend) get_calls() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	calls := b.calls
+	b.calls = nil
+	return calls
+}
+
+func (b *fakeBackend) link_up(dev string, mtu int) error { return b.record("link_up "+dev) }
+func (b *fakeBackend) link_netns(dev string, netns string) error { return b.record("link_netns "+dev+" "+netns) }
+func (b *fakeBackend) addr_add(dev string, prefix netip.Prefix) error { return b.record("addr_add "+dev+" "+prefix.String()) }
+func (b *fakeBackend) addr_del(dev string, prefix netip.Prefix) error { return b.record("addr_del "+dev+" "+prefix.String()) }
+
+func (b *fakeBackend) route(mode string, dev string, prefix netip.Prefix, table int) error {
+	return b.record(fmt.Sprintf("route %s %s %s %d", mode, dev, prefix.String(), table))
+}
+
+func (b *fakeBackend) rule(mode string, rule netRule) error {
+	return b.record(fmt.Sprintf("rule %s %d %d", mode, rule.priority, rule.table))
+}
+
+func use_fake_backend(t *testing.T) *fakeBackend {
+	net_backend_once.Do(func() {})
+	old := net_backend_impl
+	backend := &fakeBackend{}
+	net_backend_impl = backend
+	t.Cleanup(func() { net_backend_impl = old })
+	return backend
+}
+
+func TestSetupRoute(t *testing.T) {
+	backend := use_fake_backend(t)
+
+	err := setup_route("add", "tun0", netip.MustParsePrefix("10.1.2.3/24"), 443)
+	if err != nil { t.Fatal(err) }
+	want := []string{ fmt.Sprintf("route add tun0 10.1.2.0/24 %d", TABLE_MAIN) }
+	if calls := backend.get_calls(); !slices.Equal(calls, want) {
+		t.Errorf("Calls %v, want %v", calls, want)
+	}
+
+	// existing rules of a previous run are not an error for a default route
+	backend.fail = map[string]error{ fmt.Sprintf("rule add %d %d", RULE_PRIO, TABLE_MAIN): ErrNetExists }
+	err = setup_route("add", "tun0", netip.MustParsePrefix("::/0"), 443)
+	if err != nil { t.Errorf("Default route failed: %s", err) }
+	if calls := backend.get_calls(); len(calls) != 4 || calls[3] != fmt.Sprintf("route add tun0 ::/0 %d", TABLE_VPN) {
+		t.Errorf("Unexpected default route calls %v", calls)
+	}
+
+	// a route already gone is ignored on removal
+	backend.fail = map[string]error{ fmt.Sprintf("route del tun0 10.1.2.0/24 %d", TABLE_MAIN): ErrNetNotFound }
+	remove_route("tun0", netip.MustParsePrefix("10.1.2.0/24"), 443)
+	if calls := backend.get_calls(); len(calls) != 1 {
+		t.Errorf("Unexpected removal calls %v", calls)
+	}
+}
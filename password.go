@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RFC 9106 second recommended option
+const (
+	ARGON2_TIME = 3
+	ARGON2_MEMORY = 64 * 1024
+	ARGON2_THREADS = 4
+	ARGON2_SALT_LEN = 16
+	ARGON2_KEY_LEN = 32
+)
+
+var b64 = base64.RawStdEncoding
+
+// Each argon2id verification takes 64MiB, run at most one per CPU at a time
+var hash_slots = make(chan struct{}, runtime.NumCPU())
+
+// Verified against unknown users to burn the same CPU time
+var dummy_hash string
+var dummy_once sync.Once
+
+func get_dummy_hash() string {
+	dummy_once.Do(func() { dummy_hash = hash_password(get_random_password(16)) })
+	return dummy_hash
+}
+
+func is_bcrypt_hash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Anything but argon2id or bcrypt, a plain text password may start with $ as well
+func is_legacy_hash(hash string) bool {
+	return !strings.HasPrefix(hash, "$argon2id$") && !is_bcrypt_hash(hash)
+}
+
+// Hash in PHC string format for argon2id or modular crypt format for bcrypt
+func hash_password(password string) string {
+	if rcfg().password_hash == "bcrypt" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil { panic(err) }
+		return string(hash)
+	}
+
+	salt := make([]byte, ARGON2_SALT_LEN)
+	_, err := rand.Read(salt)
+	if err != nil { panic(err) }
+	key := argon2.IDKey([]byte(password), salt, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, ARGON2_KEY_LEN)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		ARGON2_MEMORY, ARGON2_TIME, ARGON2_THREADS, b64.EncodeToString(salt), b64.EncodeToString(key))
+}
+
+func verify_argon2id(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 { return false }
+
+	var version int
+	var memory, time uint32
+	var threads uint8
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version { return false }
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil { return false }
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil { return false }
+	key, err := b64.DecodeString(parts[5])
+	if err != nil { return false }
+
+	remote_key := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, remote_key) == 1
+}
+
+// Legacy entries are a SHA-256 hex digest or a plain text password
+func verify_legacy(hash string, password string) bool {
+	stored := get_hashed_password(hash)
+	remote := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(stored, remote[:]) == 1
+}
+
+func verify_password(hash string, password string) bool {
+	hash_slots <- struct{}{}
+	defer func() { <-hash_slots }()
+
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verify_argon2id(hash, password)
+	case is_bcrypt_hash(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	return verify_legacy(hash, password)
+}
+
+func get_hashed_password(password string) []byte {
+	if len(password) == 64 {
+		data, err := hex.DecodeString(password)
+		if err == nil { return data }
+	}
+
+	data := sha256.Sum256([]byte(password))
+	return data[:]
+}
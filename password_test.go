@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func hash_password_with(hash string, password string) string {
+	old := cfg.password_hash
+	cfg.password_hash = hash
+	defer func() { cfg.password_hash = old }()
+	return hash_password(password)
+}
+
+func TestVerifyPassword(t *testing.T) {
+	argon2id := hash_password_with("argon2id", "secret pass")
+	bcrypt := hash_password_with("bcrypt", "secret pass")
+	digest := sha256.Sum256([]byte("secret pass"))
+	parts := strings.Split(argon2id, "$")
+
+	tests := []struct {
+		name string
+		hash string
+		password string
+		valid bool
+	}{
+		{ "argon2id", argon2id, "secret pass", true },
+		{ "argon2id wrong password", argon2id, "secret", false },
+		{ "argon2id wrong version", strings.Replace(argon2id, "$v=19$", "$v=16$", 1), "secret pass", false },
+		{ "argon2id broken salt", strings.Join([]string{ "", parts[1], parts[2], parts[3], "!!", parts[5] }, "$"), "secret pass", false },
+		{ "argon2id missing key", strings.Join(parts[:5], "$"), "secret pass", false },
+		{ "bcrypt", bcrypt, "secret pass", true },
+		{ "bcrypt wrong password", bcrypt, "secret", false },
+		{ "legacy sha256", hex.EncodeToString(digest[:]), "secret pass", true },
+		{ "legacy sha256 wrong password", hex.EncodeToString(digest[:]), "secret", false },
+		{ "legacy plain", "plain", "plain", true },
+		{ "legacy plain wrong password", "plain", "Plain", false },
+		{ "legacy plain with $", "$5$rounds=5000$salt$hash", "$5$rounds=5000$salt$hash", true },
+		{ "legacy plain with $ wrong password", "$5$rounds=5000$salt$hash", "secret pass", false },
+	}
+	for _, test := range tests {
+		valid := verify_password(test.hash, test.password)
+		if valid != test.valid {
+			t.Errorf("%s: verify_password = %v, want %v", test.name, valid, test.valid)
+		}
+	}
+}
+
+func TestHashPasswordFormat(t *testing.T) {
+	tests := []struct {
+		hash string
+		prefix string
+	}{
+		{ "argon2id", "$argon2id$v=19$m=65536,t=3,p=4$" },
+		{ "bcrypt", "$2a$10$" },
+	}
+	for _, test := range tests {
+		hash := hash_password_with(test.hash, "secret")
+		if !strings.HasPrefix(hash, test.prefix) || is_legacy_hash(hash) {
+			t.Errorf("%s hash %s, want prefix %s", test.hash, hash, test.prefix)
+		}
+		// salted, the same password gives a different hash
+		if hash == hash_password_with(test.hash, "secret") {
+			t.Errorf("%s hash is not salted", test.hash)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+//go:build server
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func load_server_tls_config(c *reloadConfig) (*tls.Config, error) {
+	tls_config, err := load_tls_settings(get_tls_settings(c))
+	if err != nil { return nil, err }
+	if acme_enabled() {
+		tls_config.GetCertificate = acme_get_certificate
+	}
+	if cfg.client_auth {
+		tls_config.VerifyConnection = verify_connection
+	}
+	return tls_config, nil
+}
+
+// Handshakes use the latest loaded configuration of the host selected by SNI
+func server_tls_config() *tls.Config {
+	tls_config, err := load_server_tls_config(rcfg())
+	if err != nil { log_fatal("%s", err.Error()) }
+	default_host.tls.Store(tls_config)
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			return find_vhost(hello.ServerName).tls.Load(), nil
+		},
+	}
+}
+
+func reload_init() {
+	go func() {
+		for range cfg.reload {
+			reload_config()
+		}
+	}()
+
+	if cfg.reload_watch > 0 {
+		go watch_config_files(time.Duration(cfg.reload_watch) * time.Second)
+	}
+}
+
+func get_config_files() []string {
+	c := rcfg()
+	files := []string{ cfg.config_file, c.users_file, c.tls_cert, c.tls_key }
+	files = append(files, strings.Fields(c.tls_ca)...)
+	files = append(files, strings.Fields(c.tls_client_ca)...)
+	for _, host := range vhosts {
+		files = append(files, host.config_file, host.get_users_file())
+	}
+	return files
+}
+
+// Poll modification times and trigger a reload on change
+func watch_config_files(interval time.Duration) {
+	mtimes := map[string]time.Time{}
+	changed := func() bool {
+		result := false
+		for _, file := range get_config_files() {
+			if file == "" { continue }
+			info, err := os.Stat(file)
+			if err != nil { continue }
+			if mtime, ok := mtimes[file]; ok && !mtime.Equal(info.ModTime()) {
+				log_info("Configuration file %s changed", file)
+				result = true
+			}
+			mtimes[file] = info.ModTime()
+		}
+		return result
+	}
+	changed()
+
+	for {
+		time.Sleep(interval)
+		if !changed() { continue }
+		select {
+		case cfg.reload <- syscall.SIGHUP:
+		default:
+		}
+	}
+}
+
+// Everything a reload switches over to, loaded before any of it is applied
+type reloadState struct {
+	c reloadConfig
+	tls_config *tls.Config
+	identity_config *identityConfig
+	users map[string]*userEntry
+	networks[] netip.Prefix
+	pool[] ipam_addr
+	keys[] jwtKey
+}
+
+// Load everything into a copy first so that nothing changes if one part is invalid
+func prepare_reload() (*reloadState, error) {
+	// options removed from the file return to their defaults
+	s := &reloadState{ c: default_reload_config() }
+	next := &s.c
+	options := next.options()
+	for key, value := range read_config(cfg.config_file, false) {
+		if _, ok := options[key]; !ok || cfg.cmdline[key] { continue }
+		err := next.set(key, value)
+		if err != nil { return nil, err }
+	}
+
+	err := check_reload_config(next)
+	if err != nil { return nil, err }
+	s.tls_config, err = load_server_tls_config(next)
+	if err != nil { return nil, err }
+	s.identity_config, err = load_identity_config(next)
+	if err != nil { return nil, err }
+	// a missing users file is fine as at startup
+	s.users, err = read_userdb(next.users_file)
+	if errors.Is(err, os.ErrNotExist) {
+		s.users = map[string]*userEntry{}
+	} else if err != nil {
+		return nil, err
+	}
+	s.networks, s.pool, err = ipam_build(next.ippool, next)
+	if err != nil { return nil, err }
+	err = check_vhost_networks(default_host, s.networks)
+	if err != nil { return nil, err }
+	if next.jwt_jwks != "" {
+		s.keys, err = load_jwks(next.jwt_jwks)
+		if err != nil { return nil, err }
+	}
+	return s, nil
+}
+
+// Switch over only if all parts are valid
+func reload_config() {
+	log_info("Reloading configuration")
+
+	s, err := prepare_reload()
+	if err != nil {
+		log_err("Reload failed, keeping previous configuration: %s", err.Error())
+		return
+	}
+	next := s.c
+	reloaded.Store(&next)
+	default_host.tls.Store(s.tls_config)
+	identity.Store(s.identity_config)
+
+	jwks.lock.Lock()
+	jwks.keys = s.keys
+	jwks.loaded = time.Now()
+	jwks.lock.Unlock()
+	if next.jwt_jwks != "" { jwks_start_refresh() }
+
+	users_sync.Lock()
+	// keep the generated demo user until users are added
+	if len(s.users) > 0 || cfg.client_auth {
+		default_host.users = s.users
+		default_host.users_file = next.users_file
+	}
+	users_sync.Unlock()
+
+	old_networks := default_host.ipam_networks()
+	default_host.ipam_reload(s.networks, s.pool)
+	for _, network := range s.networks {
+		if slices.Contains(old_networks, network) { continue }
+		err = setup_ip(cfg.dev, network)
+		if err != nil { log_err("Failed to add pool network %s: %s", network.String(), err.Error()) }
+	}
+	for _, network := range old_networks {
+		if slices.Contains(s.networks, network) { continue }
+		err = remove_ip(cfg.dev, network)
+		if err != nil { log_err("Failed to remove pool network %s: %s", network.String(), err.Error()) }
+	}
+
+	routes := append(slices.Clone(s.networks), parse_prefixes(next.addroutes)...)
+	default_host.set_routes(routes)
+
+	for _, host := range vhosts {
+		err := host.reload()
+		if err != nil { log_err("Reload of virtual host %s failed, keeping previous configuration: %s", host.name, err.Error()) }
+	}
+
+	crl_load()
+	kick_revoked_sessions()
+	log_info("Reloaded configuration with %d users, %d pool networks and %d routes", len(s.users), len(s.networks), len(routes))
+}
@@ -0,0 +1,106 @@
+//go:build server
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func write_pem(t *testing.T, filename string, typ string, der ...[]byte) string {
+	var data[] byte
+	for _, block := range der {
+		data = append(data, pem.EncodeToMemory(&pem.Block{ Type: typ, Bytes: block })...)
+	}
+	err := os.WriteFile(filename, data, 0600)
+	if err != nil { t.Fatal(err) }
+	return filename
+}
+
+// Self-signed server certificate and key files in dir
+func write_test_server_cert(t *testing.T, dir string) (string, string) {
+	cert, key := create_test_cert(t, &x509.Certificate{ Subject: pkix.Name{ CommonName: "server" }, DNSNames: []string{ "server" } }, nil, nil)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil { t.Fatal(err) }
+	return write_pem(t, filepath.Join(dir, "cert.pem"), "CERTIFICATE", cert.Raw), write_pem(t, filepath.Join(dir, "key.pem"), "EC PRIVATE KEY", der)
+}
+
+// Use a configuration file with the given lines for reloads
+func use_config_file(t *testing.T, lines ...string) {
+	filename := filepath.Join(t.TempDir(), "test.cfg")
+	err := os.WriteFile(filename, []byte(strings.Join(lines, "\n") + "\n"), 0600)
+	if err != nil { t.Fatal(err) }
+	old := cfg.config_file
+	cfg.config_file = filename
+	t.Cleanup(func() { cfg.config_file = old })
+}
+
+// Register the server flags with their defaults and arguments on a fresh command line
+func use_server_flags(t *testing.T, args ...string) {
+	old_flags := flag.CommandLine
+	old_cfg := cfg
+	t.Cleanup(func() {
+		flag.CommandLine = old_flags
+		cfg = old_cfg
+	})
+
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	server_flags()
+	err := flag.CommandLine.Parse(args)
+	if err != nil { t.Fatal(err) }
+	cfg.cmdline = map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { cfg.cmdline[f.Name] = true })
+}
+
+func TestPrepareReloadWithoutUsersFile(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := write_test_server_cert(t, dir)
+	use_server_flags(t)
+	use_config_file(t, "cert: "+cert, "key: "+key, "pool: 10.9.0.1/24", "users_file: "+filepath.Join(dir, "users.db"))
+
+	s, err := prepare_reload()
+	if err != nil { t.Fatal(err) }
+	if len(s.users) != 0 || len(s.networks) != 1 || s.tls_config == nil {
+		t.Errorf("Reload prepared %d users, networks %v", len(s.users), s.networks)
+	}
+}
+
+func TestPrepareReloadDefaults(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := write_test_server_cert(t, dir)
+	use_server_flags(t, "-max_pool_size", "7")
+	use_reload_config(t, reloadConfig{ lease_time: 5, pool_exhausted: "queue", max_pool_size: 20 })
+	use_config_file(t, "cert: "+cert, "key: "+key, "pool: 10.9.0.1/24", "max_pool_size: 30")
+
+	s, err := prepare_reload()
+	if err != nil { t.Fatal(err) }
+	// removed options return to their default, command line arguments win over the file
+	if s.c.lease_time != 86400 || s.c.pool_exhausted != "reject" || s.c.max_pool_size != 7 {
+		t.Errorf("Reloaded lease_time %d, pool_exhausted %s, max_pool_size %d", s.c.lease_time, s.c.pool_exhausted, s.c.max_pool_size)
+	}
+}
+
+func TestPrepareReloadOverlap(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := write_test_server_cert(t, dir)
+	use_server_flags(t)
+	old := vhosts
+	t.Cleanup(func() { vhosts = old })
+	other := &vhost{ name: "other" }
+	other.ipam.networks = []netip.Prefix{ netip.MustParsePrefix("10.9.0.0/16") }
+	vhosts = []*vhost{ other }
+
+	use_config_file(t, "cert: "+cert, "key: "+key, "pool: 10.9.1.1/24")
+	_, err := prepare_reload()
+	if err == nil { t.Fatal("Pool overlapping a virtual host accepted") }
+
+	use_config_file(t, "cert: "+cert, "key: "+key, "pool: 10.10.1.1/24")
+	_, err = prepare_reload()
+	if err != nil { t.Fatal(err) }
+}
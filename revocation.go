@@ -0,0 +1,242 @@
+//go:build server
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const OCSP_CACHE_TIME = 1 * time.Hour
+const OCSP_FAILURE_CACHE_TIME = 1 * time.Minute
+const OCSP_TIMEOUT = 5 * time.Second
+
+type ocspEntry struct {
+	status int
+	expires time.Time
+}
+
+var revocation struct {
+	crls map[string]*x509.RevocationList
+	ocsp map[string]ocspEntry
+	pending map[string]chan struct{}
+	lock sync.RWMutex
+}
+
+func parse_crl(data []byte) (*x509.RevocationList, error) {
+	block, _ := pem.Decode(data)
+	if block != nil {
+		if block.Type != "X509 CRL" { return nil, errors.New("Unexpected PEM block "+block.Type) }
+		data = block.Bytes
+	}
+	return x509.ParseRevocationList(data)
+}
+
+// Load all CRL files, a file failing to load keeps its previous list
+func crl_load() error {
+	crls := map[string]*x509.RevocationList{}
+	var failed error
+
+	revocation.lock.RLock()
+	for _, file := range strings.Fields(rcfg().tls_crl) {
+		data, err := os.ReadFile(file)
+		if err == nil {
+			crls[file], err = parse_crl(data)
+		}
+		if err != nil {
+			log_err("Failed to load CRL %s: %s", file, err.Error())
+			failed = err
+			if revocation.crls[file] != nil {
+				crls[file] = revocation.crls[file]
+			} else {
+				delete(crls, file)
+			}
+			continue
+		}
+		if !crls[file].NextUpdate.IsZero() && time.Now().After(crls[file].NextUpdate) {
+			log_warn("CRL %s is outdated since %s", file, crls[file].NextUpdate.Format(time.RFC3339))
+		}
+	}
+	revocation.lock.RUnlock()
+
+	revocation.lock.Lock()
+	revocation.crls = crls
+	revocation.lock.Unlock()
+	return failed
+}
+
+func revocation_init() {
+	revocation.ocsp = map[string]ocspEntry{}
+	revocation.pending = map[string]chan struct{}{}
+	err := crl_load()
+	if err != nil { log_fatal("Cant load CRL: %s", err.Error()) }
+
+	if cfg.crl_refresh <= 0 { return }
+	go func() {
+		for {
+			time.Sleep(time.Duration(cfg.crl_refresh) * time.Second)
+			crl_load()
+			kick_revoked_sessions()
+		}
+	}()
+}
+
+// CRL must be signed by the issuer of the certificate
+func crl_revoked(cert *x509.Certificate, issuer *x509.Certificate) bool {
+	revocation.lock.RLock()
+	defer revocation.lock.RUnlock()
+
+	for file, crl := range revocation.crls {
+		if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) { continue }
+		err := crl.CheckSignatureFrom(issuer)
+		if err != nil {
+			log_debug("Ignoring CRL %s: %s", file, err.Error())
+			continue
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 { return true }
+		}
+	}
+	return false
+}
+
+func ocsp_query(cert *x509.Certificate, issuer *x509.Certificate) (*ocsp.Response, error) {
+	if len(cert.OCSPServer) == 0 { return nil, errors.New("No OCSP responder in certificate") }
+
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil { return nil, err }
+
+	client := http.Client{ Timeout: OCSP_TIMEOUT }
+	rsp, err := client.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil { return nil, err }
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK { return nil, errors.New("OCSP responder returned "+rsp.Status) }
+
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, 1 << 20))
+	if err != nil { return nil, err }
+	return ocsp.ParseResponseForCert(body, cert, issuer)
+}
+
+func ocsp_key(cert *x509.Certificate) string {
+	return string(cert.RawIssuer) + cert.SerialNumber.String()
+}
+
+func ocsp_cached(cert *x509.Certificate) (int, bool) {
+	revocation.lock.RLock()
+	defer revocation.lock.RUnlock()
+	entry, ok := revocation.ocsp[ocsp_key(cert)]
+	if !ok || time.Now().After(entry.expires) { return ocsp.Unknown, false }
+	return entry.status, true
+}
+
+// Query the responder once for concurrent handshakes, failures are cached briefly as unknown
+func ocsp_fetch(cert *x509.Certificate, issuer *x509.Certificate) int {
+	key := ocsp_key(cert)
+
+	revocation.lock.Lock()
+	if pending, ok := revocation.pending[key]; ok {
+		revocation.lock.Unlock()
+		<-pending
+		status, _ := ocsp_cached(cert)
+		return status
+	}
+	pending := make(chan struct{})
+	revocation.pending[key] = pending
+	revocation.lock.Unlock()
+
+	entry := ocspEntry{ status: ocsp.Unknown, expires: time.Now().Add(OCSP_FAILURE_CACHE_TIME) }
+	rsp, err := ocsp_query(cert, issuer)
+	if err != nil {
+		log_warn("OCSP check for %s failed: %s", cert.Subject.String(), err.Error())
+	} else {
+		entry = ocspEntry{ status: rsp.Status, expires: rsp.NextUpdate }
+		if entry.expires.IsZero() || entry.expires.After(time.Now().Add(OCSP_CACHE_TIME)) {
+			entry.expires = time.Now().Add(OCSP_CACHE_TIME)
+		}
+	}
+
+	revocation.lock.Lock()
+	now := time.Now()
+	for key, cached := range revocation.ocsp {
+		if now.After(cached.expires) { delete(revocation.ocsp, key) }
+	}
+	revocation.ocsp[key] = entry
+	delete(revocation.pending, key)
+	close(pending)
+	revocation.lock.Unlock()
+	return entry.status
+}
+
+// Cached OCSP status, without wait the query runs in the background and a revoked
+// certificate closes its sessions once the response arrives
+func ocsp_status(cert *x509.Certificate, issuer *x509.Certificate, wait bool) int {
+	status, ok := ocsp_cached(cert)
+	if ok { return status }
+	if wait { return ocsp_fetch(cert, issuer) }
+
+	go func() {
+		if ocsp_fetch(cert, issuer) == ocsp.Revoked {
+			kick_revoked_sessions()
+		}
+	}()
+	return ocsp.Unknown
+}
+
+func check_revocation(cert *x509.Certificate, issuer *x509.Certificate) error {
+	if crl_revoked(cert, issuer) {
+		return errors.New("Certificate "+cert.Subject.String()+" revoked by CRL")
+	}
+
+	switch rcfg().ocsp {
+	case "soft", "hard":
+		status := ocsp_status(cert, issuer, rcfg().ocsp == "hard")
+		if status == ocsp.Revoked {
+			return errors.New("Certificate "+cert.Subject.String()+" revoked by OCSP")
+		}
+		if status != ocsp.Good && rcfg().ocsp == "hard" {
+			return errors.New("Certificate "+cert.Subject.String()+" has no valid OCSP status")
+		}
+	}
+	return nil
+}
+
+// Reject revoked client certificates during the handshake
+func verify_connection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 { return nil }
+	err := check_issuer(&state)
+	if err == nil {
+		chain := state.VerifiedChains[0]
+		err = check_revocation(chain[0], chain[1])
+	}
+	if err != nil {
+		log_info("Rejecting client: %s", err.Error())
+		stats.auth_failures.Add(1)
+	}
+	return err
+}
+
+func session_revoked(cert *x509.Certificate, issuer *x509.Certificate) bool {
+	if crl_revoked(cert, issuer) { return true }
+	status, _ := ocsp_cached(cert)
+	return status == ocsp.Revoked
+}
+
+// Close sessions whose certificate got revoked by a refreshed CRL or an OCSP response
+func kick_revoked_sessions() {
+	count := kick_sessions(func(conn *Connection) bool {
+		return conn.cert != nil && session_revoked(conn.cert, conn.issuer)
+	}, REASON_REVOKED)
+	if count > 0 {
+		log_info("Closed %d sessions with revoked certificates", count)
+	}
+}
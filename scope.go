@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const IPPROTO_ANY = -1
+const SCOPE_RESOLVE_TIMEOUT = 5 * time.Second
+
+// Tunnel scope requested by the connect-ip URI template variables
+type ipScope struct {
+	targets[] netip.Prefix
+	ipproto int
+}
+
+func match_uri_template(template string, path string) (map[string]string, bool) {
+	template_parts := strings.Split(template, "/")
+	path_parts := strings.Split(path, "/")
+	if len(template_parts) != len(path_parts) { return nil, false }
+
+	vars := map[string]string{}
+	for i, part := range template_parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			value, err := url.PathUnescape(path_parts[i])
+			if err != nil { return nil, false }
+			vars[part[1:len(part)-1]] = value
+		} else if part != path_parts[i] {
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+func expand_uri_template(template string, vars map[string]string) string {
+	for key, value := range vars {
+		if value != "*" {
+			value = url.PathEscape(value)
+		}
+		template = strings.ReplaceAll(template, "{"+key+"}", value)
+	}
+	return template
+}
+
+func parse_target(ctx context.Context, target string) ([]netip.Prefix, error) {
+	if target == "" || target == "*" { return nil, nil }
+	target = strings.Trim(target, "[]")
+
+	prefix, err := netip.ParsePrefix(target)
+	if err == nil { return []netip.Prefix{ prefix.Masked() }, nil }
+
+	addr, err := netip.ParseAddr(target)
+	if err == nil { return []netip.Prefix{ netip.PrefixFrom(addr, addr.BitLen()) }, nil }
+
+	ctx, cancel := context.WithTimeout(ctx, SCOPE_RESOLVE_TIMEOUT)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", target)
+	if err != nil { return nil, err }
+
+	var targets[] netip.Prefix
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		targets = append(targets, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return targets, nil
+}
+
+func parse_ipproto(ipproto string) (int, error) {
+	if ipproto == "" || ipproto == "*" { return IPPROTO_ANY, nil }
+	proto, err := strconv.Atoi(ipproto)
+	if err != nil { return 0, err }
+	if proto < 0 || proto > 255 { return 0, errors.New("IP protocol out of range") }
+	return proto, nil
+}
+
+// Hostnames are resolved within the lifetime of the request
+func parse_scope(ctx context.Context, vars map[string]string) (*ipScope, error) {
+	targets, err := parse_target(ctx, vars["target"])
+	if err != nil { return nil, err }
+	ipproto, err := parse_ipproto(vars["ipproto"])
+	if err != nil { return nil, err }
+
+	if len(targets) == 0 && ipproto == IPPROTO_ANY {
+		return nil, nil
+	}
+	return &ipScope{ targets: targets, ipproto: ipproto }, nil
+}
+
+func (s *ipScope) protocol() uint8 {
+	if s == nil || s.ipproto == IPPROTO_ANY { return 0 }
+	return uint8(s.ipproto)
+}
+
+func (s *ipScope) allows(dst netip.Addr, proto uint8) bool {
+	if s == nil { return true }
+	if s.ipproto != IPPROTO_ANY && int(proto) != s.ipproto {
+		return false
+	}
+	if len(s.targets) == 0 { return true }
+	for _, target := range s.targets {
+		if target.Contains(dst) { return true }
+	}
+	return false
+}
+
+// Restrict routes to the scope, keeping the more specific prefix of each overlap
+func (s *ipScope) routes(routes []netip.Prefix) []netip.Prefix {
+	if s == nil || len(s.targets) == 0 { return routes }
+
+	var scoped[] netip.Prefix
+	for _, route := range routes {
+		for _, target := range s.targets {
+			if !route.Overlaps(target) { continue }
+			if route.Bits() > target.Bits() {
+				scoped = append(scoped, route)
+			} else {
+				scoped = append(scoped, target)
+			}
+		}
+	}
+	return scoped
+}
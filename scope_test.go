@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		target string
+		ipproto string
+		targets[] netip.Prefix
+		proto int
+		scoped bool
+		fails bool
+	}{
+		{ target: "*", ipproto: "*" },
+		{ target: "", ipproto: "" },
+		{ target: "192.0.2.1", ipproto: "*", scoped: true, proto: IPPROTO_ANY,
+			targets: []netip.Prefix{ netip.MustParsePrefix("192.0.2.1/32") } },
+		{ target: "192.0.2.77/24", ipproto: "6", scoped: true, proto: 6,
+			targets: []netip.Prefix{ netip.MustParsePrefix("192.0.2.0/24") } },
+		{ target: "[2001:db8::1]", ipproto: "*", scoped: true, proto: IPPROTO_ANY,
+			targets: []netip.Prefix{ netip.MustParsePrefix("2001:db8::1/128") } },
+		{ target: "2001:db8::/32", ipproto: "17", scoped: true, proto: 17,
+			targets: []netip.Prefix{ netip.MustParsePrefix("2001:db8::/32") } },
+		{ target: "*", ipproto: "58", scoped: true, proto: 58 },
+		{ target: "localhost", ipproto: "*", scoped: true, proto: IPPROTO_ANY },
+		{ target: "*", ipproto: "256", fails: true },
+		{ target: "*", ipproto: "-1", fails: true },
+		{ target: "*", ipproto: "tcp", fails: true },
+		{ target: "host.invalid", ipproto: "*", fails: true },
+	}
+	for _, test := range tests {
+		scope, err := parse_scope(context.Background(), map[string]string{ "target": test.target, "ipproto": test.ipproto })
+		if test.fails {
+			if err == nil { t.Errorf("parse_scope(%q, %q) accepted", test.target, test.ipproto) }
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse_scope(%q, %q) failed: %s", test.target, test.ipproto, err.Error())
+			continue
+		}
+		if (scope != nil) != test.scoped {
+			t.Errorf("parse_scope(%q, %q) scoped %v, want %v", test.target, test.ipproto, scope != nil, test.scoped)
+			continue
+		}
+		if scope == nil { continue }
+		if scope.ipproto != test.proto {
+			t.Errorf("parse_scope(%q, %q) protocol %d, want %d", test.target, test.ipproto, scope.ipproto, test.proto)
+		}
+		if test.targets != nil && !slices.Equal(scope.targets, test.targets) {
+			t.Errorf("parse_scope(%q, %q) targets %v, want %v", test.target, test.ipproto, scope.targets, test.targets)
+		}
+	}
+}
+
+func TestScopeResolveCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := parse_target(ctx, "example.com")
+	if err == nil {
+		t.Fatal("Resolving with canceled context succeeded")
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	scope := &ipScope{ targets: []netip.Prefix{ netip.MustParsePrefix("192.0.2.0/24") }, ipproto: 6 }
+	tests := []struct {
+		scope *ipScope
+		dst string
+		proto uint8
+		allowed bool
+	}{
+		{ nil, "198.51.100.1", 17, true },
+		{ scope, "192.0.2.10", 6, true },
+		{ scope, "192.0.2.10", 17, false },
+		{ scope, "198.51.100.1", 6, false },
+		{ &ipScope{ ipproto: 17 }, "198.51.100.1", 17, true },
+		{ &ipScope{ ipproto: IPPROTO_ANY, targets: scope.targets }, "192.0.2.255", 1, true },
+	}
+	for _, test := range tests {
+		allowed := test.scope.allows(netip.MustParseAddr(test.dst), test.proto)
+		if allowed != test.allowed {
+			t.Errorf("allows(%s, %d) = %v, want %v", test.dst, test.proto, allowed, test.allowed)
+		}
+	}
+}
+
+func TestScopeRoutes(t *testing.T) {
+	routes := []netip.Prefix{ netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.0/24") }
+	tests := []struct {
+		targets string
+		routes string
+	}{
+		{ "10.1.0.0/16", "10.1.0.0/16" },
+		{ "0.0.0.0/0", "10.0.0.0/8 192.0.2.0/24" },
+		{ "192.0.2.5/32 10.0.0.0/7", "10.0.0.0/8 192.0.2.5/32" },
+		{ "198.51.100.0/24", "" },
+	}
+	for _, test := range tests {
+		scope := &ipScope{ targets: parse_prefixes(test.targets), ipproto: IPPROTO_ANY }
+		scoped := scope.routes(routes)
+		slices.SortFunc(scoped, func(a, b netip.Prefix) int { return a.Addr().Compare(b.Addr()) })
+		if !slices.Equal(scoped, parse_prefixes(test.routes)) {
+			t.Errorf("routes for %s = %v, want %s", test.targets, scoped, test.routes)
+		}
+	}
+}
+
+func TestMatchUriTemplate(t *testing.T) {
+	tests := []struct {
+		path string
+		target string
+		ipproto string
+		ok bool
+	}{
+		{ "/.well-known/masque/ip/*/*/", "*", "*", true },
+		{ "/.well-known/masque/ip/192.0.2.0%2F24/6/", "192.0.2.0/24", "6", true },
+		{ "/.well-known/masque/ip/2001:db8::1/17/", "2001:db8::1", "17", true },
+		{ "/.well-known/masque/udp/*/*/", "", "", false },
+		{ "/.well-known/masque/ip/*/", "", "", false },
+	}
+	for _, test := range tests {
+		vars, ok := match_uri_template(MASQUE_PATH, test.path)
+		if ok != test.ok {
+			t.Errorf("match_uri_template(%s) = %v, want %v", test.path, ok, test.ok)
+			continue
+		}
+		if ok && (vars["target"] != test.target || vars["ipproto"] != test.ipproto) {
+			t.Errorf("match_uri_template(%s) = %v", test.path, vars)
+		}
+	}
+}
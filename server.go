@@ -3,12 +3,16 @@ package main
 
 import (
 	"bytes"
-
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net"
 	"net/netip"
 	"net/http"
-	"strings"
+	"os"
+	"time"
 
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/quic-go/quicvarint"
 )
@@ -16,20 +20,21 @@ import (
 var BUILD_TYPE = "server"
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			run_ctl(os.Args[2:])
+			return
+		case "useradd", "userdel", "passwd", "list":
+			run_user_cmd(os.Args[1], os.Args[2:])
+			return
+		}
+	}
 	get_server_config()
 
 	log_info("Listening on UDP port %d", cfg.port);
-	cfg.local_ip = ipam_init(cfg.ippool)
-	cfg.routes = append(cfg.routes, cfg.local_ip)
-	for _, route := range strings.Fields(cfg.addroutes) {
-		prefix, err := netip.ParsePrefix(route)
-		if err != nil {
-			log_err("Failed to parse additional route %s: %s", route, err.Error())
-		} else {
-			log_debug("Adding additional route %s/%d", prefix.Addr(), prefix.Bits())
-			cfg.routes = append(cfg.routes, prefix)
-		}
-	}
+	routes := default_host.ipam_init(cfg.ippool)
+	default_host.set_routes(append(routes, parse_prefixes(cfg.addroutes)...))
 	Server(cfg.listen, cfg.port);
 
 	log_info("Waiting for all threads to stop")
@@ -37,75 +42,193 @@ func main() {
 	log_info("Exiting")
 }
 
+func check_request(r *http.Request) (int, error) {
+	if r.Method != http.MethodConnect {
+		return http.StatusMethodNotAllowed, fmt.Errorf("expected CONNECT request, got %s", r.Method)
+	}
+	// quic-go passes the :protocol pseudo-header of extended CONNECT as Proto
+	if r.Proto == "" {
+		return http.StatusNotImplemented, errors.New("CONNECT without :protocol not supported")
+	}
+	if r.Proto != CONNECT_IP_PROTOCOL {
+		return http.StatusNotImplemented, fmt.Errorf("unexpected protocol: %s", r.Proto)
+	}
+	if r.Header.Get("capsule-protocol") != "?1" {
+		return http.StatusBadRequest, errors.New("capsule protocol not offered")
+	}
+	return http.StatusOK, nil
+}
+
 func Upgrade(w http.ResponseWriter, r *http.Request) error {
 	log_info("Upgrading HTTP request")
 	dump_request(r)
 
-	if r.Method != http.MethodConnect {
-		return fmt.Errorf("expected CONNECT request, got %s", r.Method)
-	}
-	if r.Proto != "connect-ip" {
-		return fmt.Errorf("unexpected protocol: %s", r.Proto)
-	}
 	w.Header().Add("capsule-protocol", "?1")
 	w.WriteHeader(http.StatusOK)
 	w.(http.Flusher).Flush()
 	return nil
 }
 
-func basic_auth(r *http.Request) string {
+// Authenticated peer of a tunnel request, kept for accounting
+type tunnelPeer struct {
+	remote string
+	auth string
+	subject string
+	groups[] string
+	cert *x509.Certificate
+	issuer *x509.Certificate
+}
+
+func basic_auth(host *vhost, r *http.Request) string {
 	username, password, ok := r.BasicAuth()
 	if !ok { return "" }
 
-	ok = authenticate(username, password)
+	ok = host.authenticate(username, password)
 	if !ok {
-		log_info("Failed authentication for %s from %s", username, r.RemoteAddr)
+		log_fields("user", username, "remote", r.RemoteAddr).info("Failed authentication for %s from %s", username, r.RemoteAddr)
+		stats.auth_failures.Add(1)
 		return ""
 	}
 
 	return username
 }
 
-func Server(listen string, port int) {
-	dev := create_tun()
-	AddConnection(dev, DEFAULT_IP, "")
-	setup_ip(ipam.network)
+func tunnel_handler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	// method and protocol first, a plain CONNECT has no path to match the template
+	status, err := check_request(r)
+	if err != nil {
+		log_fields("remote", r.RemoteAddr).info("Invalid request from %s: %s", r.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), status)
+		return
+	}
 
-	listen = fmt.Sprintf("%s:%d", listen, port)
+	vars, ok := match_uri_template(cfg.uri_template, r.URL.EscapedPath())
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
-	handler := http.NewServeMux()
-	handler.HandleFunc(MASQUE_PATH, func(w http.ResponseWriter, r *http.Request) {
-		username := ""
+	host := find_vhost(r.TLS.ServerName)
+	authority := r.Host
+	if name, _, err := net.SplitHostPort(authority); err == nil { authority = name }
+	if find_vhost(authority) != host {
+		log_fields("remote", r.RemoteAddr).info("Request for %s on connection for %s from %s", r.Host, r.TLS.ServerName, r.RemoteAddr)
+		http.Error(w, "Misdirected request", http.StatusMisdirectedRequest)
+		return
+	}
+	username := ""
+	peer := tunnelPeer{ remote: r.RemoteAddr }
+
+	// a client certificate is kept whatever the request authenticates with,
+	// so that a later revocation closes the session
+	if len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 1 {
+		peer.cert = r.TLS.VerifiedChains[0][0]
+		peer.issuer = r.TLS.VerifiedChains[0][1]
+	}
 
-		if cfg.client_auth {
-			username = GetTLSUser(r.TLS)
-		} else {
-			username = basic_auth(r)
+	if host.bearer_enabled() && is_bearer(r) {
+		username, peer.groups = bearer_auth(r)
+		peer.auth = "bearer"
+	} else if host.client_auth {
+		username = GetTLSUser(r.TLS)
+		peer.auth = "mtls"
+		if username != "" {
+			peer.subject = r.TLS.PeerCertificates[0].Subject.String()
 		}
+	} else {
+		username = basic_auth(host, r)
+		peer.auth = "basic"
+	}
 
-		if username == "" {
-			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+	// soft OCSP answers can arrive after the handshake
+	if username != "" && peer.cert != nil && session_revoked(peer.cert, peer.issuer) {
+		log_fields("remote", r.RemoteAddr).info("Rejecting revoked certificate %s", peer.cert.Subject.String())
+		username = ""
+	}
+
+	if username == "" {
+		if peer.auth == "mtls" { stats.auth_failures.Add(1) }
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		if host.bearer_enabled() {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="restricted"`)
 		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-		log_info("User %s authenticated from %s", username, r.RemoteAddr)
+	log := log_fields("user", username, "remote", r.RemoteAddr)
+	if user_disabled(username) {
+		log.info("Rejecting disabled user %s from %s", username, r.RemoteAddr)
+		http.Error(w, "User disabled", http.StatusForbidden)
+		return
+	}
 
-		err := Upgrade(w, r)
-		if err != nil {
-			log_err("Upgrading failed: %s", err.Error())
-			w.WriteHeader(500)
-			return
-		}
-		wg.Add(1)
-		go setup_tunnel(r.Body.(http3.HTTPStreamer).HTTPStream(), w.(http3.Datagrammer), username)
-	})
+	log.info("User %s authenticated from %s", username, r.RemoteAddr)
+
+	if admin.draining.Load() {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	// target hostnames are resolved, only for authenticated users
+	scope, err := parse_scope(r.Context(), vars)
+	if err != nil {
+		log.info("Invalid tunnel scope from %s: %s", r.RemoteAddr, err.Error())
+		http.Error(w, "Invalid tunnel scope", http.StatusBadRequest)
+		return
+	}
+
+	if rcfg().pool_exhausted == "reject" && host.ipam_available(username) == 0 {
+		log.err("Rejecting user %s from %s, address pool exhausted", username, r.RemoteAddr)
+		stats.pool_exhausted.Add(1)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Address pool exhausted", http.StatusServiceUnavailable)
+		return
+	}
+
+	err = Upgrade(w, r)
+	if err != nil {
+		log.err("Upgrading failed: %s", err.Error())
+		return
+	}
+	stats.handshake.observe(time.Since(start))
+	wg.Add(1)
+	go setup_tunnel(r.Body.(http3.HTTPStreamer).HTTPStream(), new_ip_datagrammer(w.(http3.Datagrammer)), username, peer, scope, host)
+}
+
+func Server(listen string, port int) {
+	dev := create_tun(cfg.dev)
+	cfg.dev = dev.name
+	default_host.dev = dev.name
+	err := AddConnection(NewConnection(dev, []netip.Prefix{ DEFAULT_PREFIX }, "", nil, default_host))
+	if err != nil { log_fatal("Failed to add tun device: %s", err.Error()) }
+	for _, network := range default_host.ipam_networks() {
+		err := setup_ip(cfg.dev, network)
+		if err != nil { log_fatal("Failed to configure tun device: %s", err.Error()) }
+	}
+	vhost_init()
+
+	admin_init(cfg.admin_socket)
+	metrics_init(cfg.metrics)
+	accounting_init()
+	reload_init()
+	jwks_init()
+	identity_init()
+	revocation_init()
+	acme_init()
+	listen = fmt.Sprintf("%s:%d", listen, port)
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/", tunnel_handler)
 
 	server := http3.Server{
 		Addr: listen,
 		QuicConfig: quic_cfg,
 		EnableDatagrams: true,
-		TLSConfig: generateTLSConfig(true),
+		AdditionalSettings: map[uint64]uint64{ SETTINGS_ENABLE_CONNECT_PROTOCOL: 1 },
+		TLSConfig: server_tls_config(),
 		Handler: handler,
 	}
 
@@ -116,56 +239,144 @@ func Server(listen string, port int) {
 	}()
 
 	// Start HTTP3 server
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if (err != nil && err != http.ErrServerClosed) {
 		log_fatal("Cant listen on %s: %s", listen, err.Error())
 	}
 
+	if cfg.admin_socket != "" {
+		os.Remove(cfg.admin_socket)
+	}
 	dev.Close()
 }
 
-func setup_tunnel(str http3.Stream, datagrammer http3.Datagrammer, username string) {
+func close_stream(str http3.Stream) {
+	str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestRejected))
+	str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestRejected))
+}
+
+func setup_tunnel(str http3.Stream, datagrammer http3.Datagrammer, username string, peer tunnelPeer, scope *ipScope, host *vhost) {
 	defer wg.Done()
-	log_info("Setting up VPN tunnel over stream %d for %s", str.StreamID(), username)
+	log := log_fields("user", username, "remote", peer.remote, "stream", str.StreamID())
+	log.info("Setting up VPN tunnel over stream %d for %s", str.StreamID(), username)
 	address_requested := false
-	var client_ip *netip.Addr
+	var client_ips[] netip.Prefix
+	var conn *Connection
+	var read_err error
 
 	for {
                 capsule, err := parse_ip_capsule(quicvarint.NewReader(str))
-		if err != nil { break }
+		if err != nil {
+			read_err = err
+			break
+		}
 		if capsule == nil { continue }
 
 		switch capsule.typ {
 		case ADDRESS_REQUEST:
 			if address_requested {
-				log_warn("Multiple address requests not supported")
+				log.warn("Multiple address requests not supported")
 				continue
 			}
 			address_requested = true
 
-			client_ip = ipam_get(capsule.address.Addr())
-			AddConnection(datagrammer, *client_ip, username)
+			var assigned[] capsule_entry
+			for _, request := range get_address_requests(host, capsule.entries) {
+				client_ip := host.ipam_acquire(request.address, username)
+				if !client_ip.IsValid() { continue }
+				client_ips = append(client_ips, client_ip)
+				assigned = append(assigned, capsule_entry{ reqid: request.reqid, address: client_ip })
+			}
+			if len(client_ips) == 0 {
+				log.err("Closing tunnel for %s, no free IP address", username)
+				close_stream(str)
+				continue
+			}
+			conn = NewConnection(datagrammer, client_ips, username, scope, host)
+			conn.close = func() { close_stream(str) }
+			conn.remote = peer.remote
+			conn.auth = peer.auth
+			conn.subject = peer.subject
+			conn.groups = peer.groups
+			conn.cert = peer.cert
+			conn.issuer = peer.issuer
+			err = AddConnection(conn)
+			if err != nil {
+				log.err("Closing tunnel for %s: %s", username, err.Error())
+				for _, client_ip := range client_ips {
+					host.ipam_free(client_ip)
+				}
+				client_ips = nil
+				conn = nil
+				close_stream(str)
+				continue
+			}
+			log = conn.log().with("stream", str.StreamID())
+			accounting_start(conn)
 
 			if cfg.benchmark {
-				go benchmark_client(client_ip.String())
+				go benchmark_client(client_ips[0].Addr().String())
 			}
 
 			var buf bytes.Buffer
-			err := AssignAddress(&buf, 0, *client_ip)
+			err := AssignAddress(&buf, assigned)
 			if err != nil { panic(err) }
 			str.Write(buf.Bytes())
 
-			for _, route := range cfg.routes {
-				buf.Reset()
-				err = AddressRange(&buf, route)
-				if err != nil { panic(err) }
-				str.Write(buf.Bytes())
+			buf.Reset()
+			err = AddressRange(&buf, scope.routes(host.get_routes()), scope.protocol())
+			if err != nil { panic(err) }
+			str.Write(buf.Bytes())
+
+		case ROUTE_ADVERTISEMENT:
+			if conn == nil {
+				log.err("Ignoring route advertisement without address assignment")
+				continue
+			}
+			var routes[] netip.Prefix
+			for _, entry := range capsule.entries {
+				if !host.user_route_allowed(username, entry.address) {
+					log.warn("Ignoring route %s from %s not in allowed routes", entry.address.String(), username)
+					continue
+				}
+				routes = append(routes, entry.address.Masked())
+			}
+			err := conn.announce(routes)
+			if err != nil {
+				log.err("Rejecting routes from %s: %s", username, err.Error())
 			}
 
 		default:
-			log_warn("Ignoring unsupported capsule %d", capsule.typ)
+			log.warn("Ignoring unsupported capsule %d", capsule.typ)
 		}
 	}
 
-	ipam_free(client_ip)
+	// addresses stay routed to the connection until it is removed
+	if conn != nil {
+		conn.set_reason(get_disconnect_reason(read_err))
+		close_stream(str)
+		<-conn.done
+		accounting_stop(conn)
+	}
+	for _, client_ip := range client_ips {
+		host.ipam_free(client_ip)
+	}
+}
+
+// Serve the first request of each pool family and add one for each family not requested
+func get_address_requests(host *vhost, entries []capsule_entry) []capsule_entry {
+	var requests[] capsule_entry
+	for _, family := range host.ipam_families() {
+		found := false
+		for _, entry := range entries {
+			if entry.address.Addr().Is4() != family.Is4() { continue }
+			requests = append(requests, entry)
+			found = true
+			break
+		}
+		if !found {
+			requests = append(requests, capsule_entry{ address: netip.PrefixFrom(family, family.BitLen()) })
+		}
+	}
+	return requests
 }
@@ -0,0 +1,40 @@
+//go:build server
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTunnelHandlerRejects(t *testing.T) {
+	old := cfg.uri_template
+	cfg.uri_template = MASQUE_PATH
+	t.Cleanup(func() { cfg.uri_template = old })
+
+	tests := []struct {
+		name string
+		method string
+		path string
+		proto string
+		capsule string
+		status int
+	}{
+		{ "GET", http.MethodGet, "/", "HTTP/3.0", "?1", http.StatusMethodNotAllowed },
+		{ "plain CONNECT", http.MethodConnect, "", "", "", http.StatusNotImplemented },
+		{ "other protocol", http.MethodConnect, "/", "websocket", "?1", http.StatusNotImplemented },
+		{ "no capsule protocol", http.MethodConnect, "/", CONNECT_IP_PROTOCOL, "", http.StatusBadRequest },
+		{ "other path", http.MethodConnect, "/other", CONNECT_IP_PROTOCOL, "?1", http.StatusNotFound },
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "https://server/", nil)
+		r.URL.Path = test.path
+		r.Proto = test.proto
+		if test.capsule != "" { r.Header.Set("capsule-protocol", test.capsule) }
+		w := httptest.NewRecorder()
+		tunnel_handler(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
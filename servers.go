@@ -0,0 +1,252 @@
+//go:build client
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const SRV_PREFIX = "srv:"
+const HAPPY_EYEBALLS_DELAY = 250 * time.Millisecond
+
+type serverEntry struct {
+	host string
+	port int
+	priority int
+	weight int
+}
+
+func (s serverEntry) String() string {
+	return net.JoinHostPort(s.host, strconv.Itoa(s.port))
+}
+
+// Parse host[:port][/weight], bare IPv6 addresses are accepted without port
+func parse_server(entry string, priority int, port int) (serverEntry, error) {
+	server := serverEntry{ priority: priority, port: port }
+
+	host, weight, found := strings.Cut(entry, "/")
+	if found {
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 { return server, errors.New("Invalid weight "+weight) }
+		server.weight = w
+	}
+
+	// srv:_name._udp.domain has no port, the target port comes from the record
+	if strings.HasPrefix(host, SRV_PREFIX) {
+		if len(host) == len(SRV_PREFIX) { return server, errors.New("Empty SRV name") }
+		server.host = host
+		return server, nil
+	}
+
+	if strings.HasPrefix(host, "[") || strings.Count(host, ":") == 1 {
+		h, p, err := net.SplitHostPort(host)
+		if err != nil { return server, err }
+		server.port, err = strconv.Atoi(p)
+		if err != nil { return server, errors.New("Invalid port "+p) }
+		host = h
+	}
+	server.host = host
+	return server, nil
+}
+
+func parse_servers(servers string, port int) []serverEntry {
+	var result[] serverEntry
+	for i, field := range strings.FieldsFunc(servers, func(r rune) bool { return r == ',' || r == ' ' }) {
+		server, err := parse_server(field, i, port)
+		if err != nil {
+			log_err("Ignoring server %s: %s", field, err.Error())
+			continue
+		}
+		result = append(result, server)
+	}
+	return result
+}
+
+func lookup_srv(server serverEntry) []serverEntry {
+	_, records, err := net.LookupSRV("", "", strings.TrimPrefix(server.host, SRV_PREFIX))
+	if err != nil {
+		log_err("Failed to lookup SRV record %s: %s", server.host, err.Error())
+		return nil
+	}
+
+	var result[] serverEntry
+	for _, record := range records {
+		result = append(result, serverEntry{
+			host: strings.TrimSuffix(record.Target, "."),
+			port: int(record.Port),
+			priority: server.priority * 65536 + int(record.Priority),
+			weight: int(record.Weight),
+		})
+	}
+	return result
+}
+
+// RFC 2782 style selection, weighted random order within equal priority
+func weighted_order(servers []serverEntry) []serverEntry {
+	var result[] serverEntry
+	remaining := append([]serverEntry{}, servers...)
+	for len(remaining) > 0 {
+		total := 0
+		for _, server := range remaining {
+			total += server.weight + 1
+		}
+		pick := rand.Intn(total)
+		for i, server := range remaining {
+			pick -= server.weight + 1
+			if pick >= 0 { continue }
+			result = append(result, server)
+			remaining = append(remaining[:i], remaining[i+1:]...)
+			break
+		}
+	}
+	return result
+}
+
+// Expand SRV records and order the configured servers by preference
+func get_server_list(servers []serverEntry) []serverEntry {
+	var expanded[] serverEntry
+	weighted := false
+	for _, server := range servers {
+		if strings.HasPrefix(server.host, SRV_PREFIX) {
+			expanded = append(expanded, lookup_srv(server)...)
+			continue
+		}
+		if server.weight > 0 { weighted = true }
+		expanded = append(expanded, server)
+	}
+
+	if weighted {
+		for i := range expanded {
+			expanded[i].priority = 0
+		}
+	}
+	sort.SliceStable(expanded, func(i, j int) bool { return expanded[i].priority < expanded[j].priority })
+
+	var result[] serverEntry
+	for start := 0; start < len(expanded); {
+		end := start
+		for end < len(expanded) && expanded[end].priority == expanded[start].priority {
+			end++
+		}
+		result = append(result, weighted_order(expanded[start:end])...)
+		start = end
+	}
+	return result
+}
+
+// Interleave address families starting with IPv6 as in RFC 8305
+func sort_happy_eyeballs(addrs []netip.Addr) []netip.Addr {
+	var v4, v6, result[] netip.Addr
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() {
+			v4 = append(v4, addr.Unmap())
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			result = append(result, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			result = append(result, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return result
+}
+
+type dialResult struct {
+	conn quic.EarlyConnection
+	err error
+}
+
+// Race QUIC handshakes to all server addresses with staggered start
+func dial_happy_eyeballs(ctx context.Context, transport *quic.Transport, addr string, tls_cfg *tls.Config, quic_cfg *quic.Config) (quic.EarlyConnection, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil { return nil, err }
+	udp_port, err := strconv.Atoi(port)
+	if err != nil { return nil, err }
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil { return nil, err }
+	addrs = sort_happy_eyeballs(addrs)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	next := time.NewTimer(0)
+	defer next.Stop()
+	pending := 0
+	started := 0
+	var last_err error
+
+	for started < len(addrs) || pending > 0 {
+		select {
+		case <-next.C:
+			if started >= len(addrs) { continue }
+			remote := net.UDPAddrFromAddrPort(netip.AddrPortFrom(addrs[started], uint16(udp_port)))
+			log_debug("Dialing %s", remote.String())
+			go func() {
+				conn, err := transport.DialEarly(ctx, remote, tls_cfg, quic_cfg)
+				results <- dialResult{ conn: conn, err: err }
+			}()
+			started++
+			pending++
+			next.Reset(HAPPY_EYEBALLS_DELAY)
+
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				cancel()
+				go close_losers(results, pending)
+				log_debug("Connected to %s", result.conn.RemoteAddr().String())
+				return result.conn, nil
+			}
+			last_err = result.err
+			// start next attempt immediately on failure
+			if started < len(addrs) {
+				next.Reset(0)
+			}
+
+		case <-ctx.Done():
+			go close_losers(results, pending)
+			return nil, ctx.Err()
+		}
+	}
+	return nil, last_err
+}
+
+func close_losers(results chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		result := <-results
+		if result.err == nil {
+			result.conn.CloseWithError(0, "")
+		}
+	}
+}
+
+// Check if a server completes a QUIC handshake
+func probe_server(transport *quic.Transport, server serverEntry) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	tls_cfg := generateTLSConfig()
+	tls_cfg.ServerName = server.host
+	conn, err := dial_happy_eyeballs(ctx, transport, server.String(), tls_cfg, quic_cfg)
+	if err != nil { return false }
+	conn.CloseWithError(0, "")
+	return true
+}
@@ -0,0 +1,135 @@
+//go:build client
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		entry string
+		host string
+		port int
+		weight int
+		valid bool
+	}{
+		{ "vpn.example.com", "vpn.example.com", 443, 0, true },
+		{ "vpn.example.com:8443", "vpn.example.com", 8443, 0, true },
+		{ "vpn.example.com/10", "vpn.example.com", 443, 10, true },
+		{ "vpn.example.com:8443/5", "vpn.example.com", 8443, 5, true },
+		{ "192.0.2.1:4433", "192.0.2.1", 4433, 0, true },
+		{ "2001:db8::1", "2001:db8::1", 443, 0, true },
+		{ "[2001:db8::1]:8443/3", "2001:db8::1", 8443, 3, true },
+		{ "srv:_h3tunnel._udp.example.com/2", "srv:_h3tunnel._udp.example.com", 443, 2, true },
+		{ "vpn.example.com/-1", "", 0, 0, false },
+		{ "vpn.example.com/x", "", 0, 0, false },
+		{ "vpn.example.com:https", "", 0, 0, false },
+		{ "[2001:db8::1", "", 0, 0, false },
+		{ "srv:", "", 0, 0, false },
+	}
+	for _, test := range tests {
+		server, err := parse_server(test.entry, 7, 443)
+		if !test.valid {
+			if err == nil { t.Errorf("Invalid %s accepted as %v", test.entry, server) }
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parsing %s failed: %s", test.entry, err)
+			continue
+		}
+		if server.host != test.host || server.port != test.port || server.weight != test.weight || server.priority != 7 {
+			t.Errorf("Parsing %s gave %+v", test.entry, server)
+		}
+	}
+}
+
+func TestParseServers(t *testing.T) {
+	servers := parse_servers("a.example.com, b.example.com:x c.example.com/2", 443)
+	if len(servers) != 2 || servers[0].host != "a.example.com" || servers[1].host != "c.example.com" {
+		t.Fatalf("Unexpected servers %v", servers)
+	}
+	// priority follows the position in the list, bad entries included
+	if servers[0].priority != 0 || servers[1].priority != 2 {
+		t.Errorf("Unexpected priorities %d %d", servers[0].priority, servers[1].priority)
+	}
+}
+
+func server_hosts(servers []serverEntry) []string {
+	var hosts[] string
+	for _, server := range servers {
+		hosts = append(hosts, server.host)
+	}
+	return hosts
+}
+
+func TestWeightedOrder(t *testing.T) {
+	servers := []serverEntry{
+		{ host: "light", weight: 0 },
+		{ host: "heavy", weight: 99 },
+		{ host: "medium", weight: 9 },
+	}
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		order := weighted_order(servers)
+		hosts := server_hosts(order)
+		sorted := slices.Clone(hosts)
+		slices.Sort(sorted)
+		if !slices.Equal(sorted, []string{ "heavy", "light", "medium" }) {
+			t.Fatalf("Order %v is no permutation", hosts)
+		}
+		first[hosts[0]]++
+	}
+	if first["heavy"] < 800 || first["heavy"] <= first["medium"] || first["medium"] <= first["light"] {
+		t.Errorf("Selection does not follow the weights: %v", first)
+	}
+	if servers[0].host != "light" || servers[1].host != "heavy" {
+		t.Errorf("Input modified")
+	}
+}
+
+func TestGetServerList(t *testing.T) {
+	// without weights the configured order is kept
+	servers := parse_servers("c.example.com b.example.com a.example.com", 443)
+	hosts := server_hosts(get_server_list(servers))
+	if !slices.Equal(hosts, []string{ "c.example.com", "b.example.com", "a.example.com" }) {
+		t.Errorf("Unexpected order %v", hosts)
+	}
+
+	// with weights all servers share one priority
+	servers = parse_servers("a.example.com/0 b.example.com/1000", 443)
+	first := 0
+	for i := 0; i < 100; i++ {
+		list := get_server_list(servers)
+		if len(list) != 2 { t.Fatalf("Unexpected list %v", list) }
+		if list[0].host == "b.example.com" { first++ }
+	}
+	if first < 80 { t.Errorf("Weighted server first only %d times", first) }
+}
+
+func TestSortHappyEyeballs(t *testing.T) {
+	tests := []struct {
+		addrs[] string
+		want[] string
+	}{
+		{ []string{ "192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2" }, []string{ "2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2" } },
+		{ []string{ "192.0.2.1", "2001:db8::1", "2001:db8::2", "2001:db8::3" }, []string{ "2001:db8::1", "192.0.2.1", "2001:db8::2", "2001:db8::3" } },
+		{ []string{ "::ffff:192.0.2.1", "192.0.2.2" }, []string{ "192.0.2.1", "192.0.2.2" } },
+		{ []string{ "2001:db8::1" }, []string{ "2001:db8::1" } },
+		{ nil, nil },
+	}
+	for _, test := range tests {
+		var addrs[] netip.Addr
+		for _, addr := range test.addrs {
+			addrs = append(addrs, netip.MustParseAddr(addr))
+		}
+		var result[] string
+		for _, addr := range sort_happy_eyeballs(addrs) {
+			result = append(result, addr.String())
+		}
+		if !slices.Equal(result, test.want) {
+			t.Errorf("Sorting %v gave %v, want %v", test.addrs, result, test.want)
+		}
+	}
+}
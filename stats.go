@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds in seconds of the handshake latency histogram
+var HANDSHAKE_BUCKETS = []float64{ 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10 }
+
+type histogram struct {
+	lock sync.Mutex
+	buckets[] uint64
+	sum float64
+	count uint64
+}
+
+// Traffic of closed sessions, live sessions are added on export
+type trafficStats struct {
+	rx_bytes int
+	tx_bytes int
+	rx_packets int
+	tx_packets int
+}
+
+var stats struct {
+	pool_exhausted atomic.Int64
+	evicted atomic.Int64
+	auth_failures atomic.Int64
+
+	drop_short atomic.Int64
+	drop_invalid atomic.Int64
+	drop_spoofed atomic.Int64
+	drop_scope atomic.Int64
+	drop_no_route atomic.Int64
+	drop_send_error atomic.Int64
+
+	handshake histogram
+
+	lock sync.Mutex
+	total trafficStats
+	users map[string]*trafficStats
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(HANDSHAKE_BUCKETS))
+	}
+	seconds := d.Seconds()
+	for i, bound := range HANDSHAKE_BUCKETS {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (t *trafficStats) add(conn *Connection) {
+	t.rx_bytes += int(conn.rx_bytes.Load())
+	t.tx_bytes += int(conn.tx_bytes.Load())
+	t.rx_packets += int(conn.rx_packets.Load())
+	t.tx_packets += int(conn.tx_packets.Load())
+}
+
+// Keep counters of a closed connection
+func stats_close_connection(conn *Connection) {
+	if conn.is_local() { return }
+
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.total.add(conn)
+	if conn.user == "" { return }
+	if stats.users == nil {
+		stats.users = make(map[string]*trafficStats)
+	}
+	user, ok := stats.users[conn.user]
+	if !ok {
+		user = &trafficStats{}
+		stats.users[conn.user] = user
+	}
+	user.add(conn)
+}
@@ -0,0 +1,89 @@
+#!/bin/bash
+# Obtain certificates from a local pebble ACME server with both challenge types.
+# PEBBLE_DIR is a pebble checkout with pebble and pebble-challtestsrv built into its bin/:
+#   git clone https://github.com/letsencrypt/pebble && cd pebble && go build -o bin/ ./cmd/...
+PEBBLE_DIR=${PEBBLE_DIR:-$HOME/pebble}
+ACME_HOST="acme.home.arpa"
+TIMEOUT=60
+
+if [ "$USER" != "root" ]; then
+	echo "Switching to root"
+	sudo PEBBLE_DIR=$PEBBLE_DIR $0 $@
+	exit
+fi
+if [ ! -x $PEBBLE_DIR/bin/pebble ] || [ ! -x $PEBBLE_DIR/bin/pebble-challtestsrv ]; then
+	echo "pebble not found in $PEBBLE_DIR/bin"
+	exit 1
+fi
+
+WORKDIR=$(mktemp -d)
+cd test
+
+# every name resolves to localhost, challenges are validated against our listener
+start_pebble()
+{
+	cat > $WORKDIR/pebble.json <<EOC
+{
+	"pebble": {
+		"listenAddress": "127.0.0.1:14000",
+		"managementListenAddress": "127.0.0.1:15000",
+		"certificate": "$PEBBLE_DIR/test/certs/localhost/cert.pem",
+		"privateKey": "$PEBBLE_DIR/test/certs/localhost/key.pem",
+		"httpPort": 5002,
+		"tlsPort": 5001,
+		"ocspResponderURL": "",
+		"externalAccountBindingRequired": false
+	}
+}
+EOC
+	$PEBBLE_DIR/bin/pebble-challtestsrv -defaultIPv4 127.0.0.1 -defaultIPv6 "" -dns01 127.0.0.1:8053 \
+		-http01 "" -https01 "" -tlsalpn01 "" -doh "" -management 127.0.0.1:8055 > $WORKDIR/challtestsrv.log 2>&1 &
+	CHALLTESTSRV_PID=$!
+	PEBBLE_VA_NOSLEEP=1 $PEBBLE_DIR/bin/pebble -config $WORKDIR/pebble.json -dnsserver 127.0.0.1:8053 > $WORKDIR/pebble.log 2>&1 &
+	PEBBLE_PID=$!
+	sleep 2
+}
+
+# start the server and wait for the certificate
+run_challenge()
+{
+	CHALLENGE=$1
+	LISTEN=$2
+	LOG=$WORKDIR/server_$CHALLENGE.log
+
+	../bin/h3tunnel --config_file config_server_basicauth.cfg --admin_socket "" --port 4443 \
+		--acme $ACME_HOST --acme_challenge $CHALLENGE --acme_listen $LISTEN \
+		--acme_directory https://127.0.0.1:14000/dir --acme_ca $PEBBLE_DIR/test/certs/pebble.minica.pem \
+		--acme_cache $WORKDIR/cache_$CHALLENGE > $LOG 2>&1 &
+	SERVER_PID=$!
+
+	RESULT=1
+	for i in $(seq $TIMEOUT); do
+		if grep -q "Certificate for $ACME_HOST ready" $LOG; then
+			RESULT=0
+			break
+		fi
+		grep -q "Failed to obtain certificate" $LOG && break
+		sleep 1
+	done
+	kill $SERVER_PID
+	wait $SERVER_PID 2>/dev/null
+
+	if [ $RESULT -eq 0 ]; then
+		echo "ACME $CHALLENGE: ok"
+	else
+		echo "ACME $CHALLENGE: failed"
+		cat $LOG
+	fi
+	return $RESULT
+}
+
+start_pebble
+
+FAILED=0
+run_challenge tls-alpn-01 127.0.0.1:5001 || FAILED=1
+run_challenge http-01 127.0.0.1:5002 || FAILED=1
+
+kill $PEBBLE_PID $CHALLTESTSRV_PID
+rm -rf $WORKDIR
+exit $FAILED
@@ -4,7 +4,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 	"github.com/quic-go/quic-go"
 )
@@ -16,59 +21,141 @@ var quic_cfg = &quic.Config {
 	KeepAlivePeriod: 20 * time.Second,
 }
 
-func generateTLSConfig(server bool) *tls.Config {
+func generateTLSConfig() *tls.Config {
+	tls_config, err := load_tls_config()
+	if err != nil { log_fatal("%s", err.Error()) }
+	return tls_config
+}
+
+// Certificate and trust settings of the main configuration or a virtual host
+type tlsSettings struct {
+	cert string
+	key string
+	ca string
+	client_ca string
+	client_auth bool
+}
+
+func get_tls_settings(c *reloadConfig) tlsSettings {
+	settings := tlsSettings{ ca: c.tls_ca, client_ca: c.tls_client_ca, client_auth: cfg.client_auth }
+	if cfg.acme == "" {
+		settings.cert = c.tls_cert
+		settings.key = c.tls_key
+	}
+	return settings
+}
+
+func load_tls_config() (*tls.Config, error) {
+	return load_tls_settings(get_tls_settings(rcfg()))
+}
+
+func load_tls_settings(settings tlsSettings) (*tls.Config, error) {
 	tls_config := tls.Config { NextProtos: QUIC_ALPN }
 
-	if (cfg.tls_cert != "" || cfg.tls_key != "") {
-		if cfg.tls_cert == "" {
-			log_fatal("TLS certificate not configured")
+	if (settings.cert != "" || settings.key != "") {
+		if settings.cert == "" {
+			return nil, errors.New("TLS certificate not configured")
 		}
-		if cfg.tls_key == "" {
-			cfg.tls_key = cfg.tls_cert
+		key := settings.key
+		if key == "" {
+			key = settings.cert
 		}
-		cert, err := tls.LoadX509KeyPair(cfg.tls_cert, cfg.tls_key)
+		cert, err := tls.LoadX509KeyPair(settings.cert, key)
 		if err != nil {
-			log_fatal("Failed to load TLS certificates: %s", err.Error())
+			return nil, fmt.Errorf("Failed to load TLS certificates: %s", err.Error())
 		}
 		tls_config.Certificates = []tls.Certificate{cert}
 	}
 
-	if cfg.tls_ca == "ignore" {
+	if settings.ca == "ignore" {
 		tls_config.InsecureSkipVerify = true
-	} else if cfg.tls_ca != "" {
-		ca_pem, err := ioutil.ReadFile(cfg.tls_ca)
-		if err != nil {
-			log_fatal("Failed to load CA certificate: %s", err.Error())
-		}
-		ca_der, _ := pem.Decode(ca_pem)
-		ca_cert, err := x509.ParseCertificate(ca_der.Bytes)
-		if err != nil {
-			log_fatal("Failed to parse CA certificate: %s", err.Error())
-		}
-		ca_pool := x509.NewCertPool()
-		ca_pool.AddCert(ca_cert)
+	} else if settings.ca != "" {
+		ca_pool, err := load_ca_pool(settings.ca)
+		if err != nil { return nil, err }
 		tls_config.RootCAs = ca_pool
 	}
 
-	if cfg.client_auth {
-		tls_config.ClientAuth = tls.RequireAndVerifyClientCert
-		if tls_config.RootCAs == nil {
-			log_fatal("CA must be configured for mutual TLS")
+	if settings.client_auth {
+		// any publicly trusted certificate would pass with system CAs
+		client_ca := settings.client_ca
+		if client_ca == "" { client_ca = settings.ca }
+		if client_ca == "" || client_ca == "ignore" {
+			return nil, errors.New("CA must be configured for mutual TLS")
 		}
-		tls_config.ClientCAs = tls_config.RootCAs
+		if slices.Contains(strings.Fields(client_ca), "system") {
+			return nil, errors.New("System CAs can not be used for client certificates, configure client_ca")
+		}
+		tls_config.ClientAuth = tls.RequireAndVerifyClientCert
+		ca_pool, err := load_ca_pool(client_ca)
+		if err != nil { return nil, err }
+		tls_config.ClientCAs = ca_pool
+	}
+
+	return &tls_config, nil
+}
+
+// PEM bundle with any number of certificates or a single DER certificate
+func load_ca_file(pool *x509.CertPool, filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil { return err }
+
+	count := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil { break }
+		if block.Type != "CERTIFICATE" { continue }
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil { return fmt.Errorf("Failed to parse CA certificate in %s: %s", filename, err.Error()) }
+		pool.AddCert(cert)
+		count++
 	}
+	if count > 0 { return nil }
 
-	return &tls_config
+	cert, err := x509.ParseCertificate(data)
+	if err != nil { return errors.New("No CA certificate found in "+filename) }
+	pool.AddCert(cert)
+	return nil
 }
 
-func GetTLSUser(state *tls.ConnectionState) string {
-	if (state == nil || len(state.PeerCertificates) == 0) {
-		return ""
+// Every certificate file in the directory, other files are skipped
+func load_ca_dir(pool *x509.CertPool, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil { return err }
+
+	count := 0
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") { continue }
+		filename := filepath.Join(dir, entry.Name())
+		err := load_ca_file(pool, filename)
+		if err != nil {
+			log_debug("Skipping %s: %s", filename, err.Error())
+			continue
+		}
+		count++
 	}
+	if count == 0 { return errors.New("No CA certificates found in "+dir) }
+	return nil
+}
 
-	cert := state.PeerCertificates[0]
-	if len(cert.EmailAddresses) == 0 {
-		return ""
+// List of CA files and directories, "system" adds the system trust store
+func load_ca_pool(sources string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if slices.Contains(strings.Fields(sources), "system") {
+		system, err := x509.SystemCertPool()
+		if err != nil { return nil, fmt.Errorf("Failed to load system CAs: %s", err.Error()) }
+		pool = system
+	}
+
+	for _, source := range strings.Fields(sources) {
+		if source == "system" { continue }
+		info, err := os.Stat(source)
+		if err == nil && info.IsDir() {
+			err = load_ca_dir(pool, source)
+		} else if err == nil {
+			err = load_ca_file(pool, source)
+		}
+		if err != nil { return nil, fmt.Errorf("Failed to load CA certificates: %s", err.Error()) }
 	}
-	return cert.EmailAddresses[0]
+	return pool, nil
 }
@@ -0,0 +1,99 @@
+//go:build server
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCaPool(t *testing.T) {
+	dir := t.TempDir()
+	var cas[] *x509.Certificate
+	var leafs[] *x509.Certificate
+	for _, name := range []string{ "CA 1", "CA 2", "CA 3", "CA 4" } {
+		ca, key := create_test_ca(t, name)
+		leaf, _ := create_test_cert(t, &x509.Certificate{ Subject: pkix.Name{ CommonName: "leaf of " + name } }, ca, key)
+		cas = append(cas, ca)
+		leafs = append(leafs, leaf)
+	}
+
+	bundle := write_pem(t, filepath.Join(dir, "bundle.pem"), "CERTIFICATE", cas[0].Raw, cas[1].Raw)
+	ca_dir := filepath.Join(dir, "certs")
+	err := os.Mkdir(ca_dir, 0700)
+	if err != nil { t.Fatal(err) }
+	write_pem(t, filepath.Join(ca_dir, "ca3.pem"), "CERTIFICATE", cas[2].Raw)
+	err = os.WriteFile(filepath.Join(ca_dir, "README"), []byte("not a certificate\n"), 0600)
+	if err != nil { t.Fatal(err) }
+	der := filepath.Join(dir, "ca4.der")
+	err = os.WriteFile(der, cas[3].Raw, 0600)
+	if err != nil { t.Fatal(err) }
+	no_pem := filepath.Join(dir, "empty.pem")
+	err = os.WriteFile(no_pem, []byte("no PEM block in here\n"), 0600)
+	if err != nil { t.Fatal(err) }
+	empty_dir := filepath.Join(dir, "empty")
+	err = os.Mkdir(empty_dir, 0700)
+	if err != nil { t.Fatal(err) }
+
+	tests := []struct {
+		name string
+		sources string
+		trusted[] bool
+		fails bool
+	}{
+		{ name: "bundle", sources: bundle, trusted: []bool{ true, true, false, false } },
+		{ name: "directory", sources: ca_dir, trusted: []bool{ false, false, true, false } },
+		{ name: "DER file", sources: der, trusted: []bool{ false, false, false, true } },
+		{ name: "several sources", sources: bundle + " " + ca_dir + " " + der, trusted: []bool{ true, true, true, true } },
+		{ name: "no PEM block", sources: no_pem, fails: true },
+		{ name: "empty directory", sources: empty_dir, fails: true },
+		{ name: "missing file", sources: filepath.Join(dir, "missing.pem"), fails: true },
+	}
+	for _, test := range tests {
+		pool, err := load_ca_pool(test.sources)
+		if test.fails {
+			if err == nil { t.Errorf("%s: accepted", test.name) }
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		for i, leaf := range leafs {
+			_, err := leaf.Verify(x509.VerifyOptions{ Roots: pool })
+			if (err == nil) != test.trusted[i] {
+				t.Errorf("%s: leaf of CA %d trusted %v, want %v", test.name, i + 1, err == nil, test.trusted[i])
+			}
+		}
+	}
+}
+
+func TestLoadTlsSettingsClientCa(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := write_test_server_cert(t, dir)
+	ca, _ := create_test_ca(t, "Client CA")
+	ca_file := write_pem(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Raw)
+
+	tests := []struct {
+		name string
+		ca string
+		client_ca string
+		fails bool
+	}{
+		{ name: "client CA", client_ca: ca_file },
+		{ name: "fallback to CA", ca: ca_file },
+		{ name: "no CA", fails: true },
+		{ name: "ignore", ca: "ignore", fails: true },
+		{ name: "system", client_ca: "system", fails: true },
+		{ name: "system with file", client_ca: "system " + ca_file, fails: true },
+		{ name: "system CA as fallback", ca: "system", fails: true },
+	}
+	for _, test := range tests {
+		_, err := load_tls_settings(tlsSettings{ cert: cert, key: key, ca: test.ca, client_ca: test.client_ca, client_auth: true })
+		if (err != nil) != test.fails {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
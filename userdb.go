@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Rewrite the users file under an exclusive lock, comments and order are kept
+func userdb_edit(filename string, edit func(lines []string) ([]string, error)) error {
+	lock, err := os.OpenFile(filename + ".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil { return err }
+	defer lock.Close()
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil { return err }
+
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) { return err }
+	var lines[] string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	lines, err = edit(lines)
+	if err != nil { return err }
+
+	tmpfile := filename + ".tmp"
+	f, err := os.OpenFile(tmpfile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil { return err }
+	for _, line := range lines {
+		fmt.Fprintln(f, line)
+	}
+	err = f.Close()
+	if err != nil { return err }
+	return os.Rename(tmpfile, filename)
+}
+
+func userdb_find(lines []string, username string) int {
+	for i, line := range lines {
+		if strings.HasPrefix(line, "#") { continue }
+		key, _, found := strings.Cut(line, ":")
+		if found && strings.TrimSpace(key) == username { return i }
+	}
+	return -1
+}
+
+// Replace the password field, old must match unless empty
+func userdb_set_password(filename string, username string, old string, hash string) error {
+	return userdb_edit(filename, func(lines []string) ([]string, error) {
+		i := userdb_find(lines, username)
+		if i < 0 { return nil, errors.New("User "+username+" not found") }
+
+		_, value, _ := strings.Cut(lines[i], ":")
+		value = strings.TrimSpace(value)
+		var options[] string
+		if value != "" {
+			password, _, fields := split_user_fields(value)
+			if old != "" && password != old {
+				return nil, errors.New("Password of "+username+" changed concurrently")
+			}
+			options = fields
+		}
+		lines[i] = strings.Join(append([]string{ username + ": " + hash }, options...), " ")
+		return lines, nil
+	})
+}
+
+// Rehash a legacy password after successful login
+func (h *vhost) upgrade_password(username string, old string, password string) {
+	users_file := h.get_users_file()
+	if users_file == "" { return }
+
+	hash := hash_password(password)
+	err := userdb_set_password(users_file, username, old, hash)
+	if err != nil {
+		log_err("Failed to upgrade password hash of %s: %s", username, err.Error())
+		return
+	}
+	users_sync.Lock()
+	user, ok := h.users[username]
+	if ok && user.password == old {
+		user.password = hash
+	}
+	users_sync.Unlock()
+	log_info("Upgraded password hash of %s to %s", username, rcfg().password_hash)
+}
+
+func read_new_password(password string) string {
+	if password != "" { return password }
+	password = read_stdin("Password")
+	if password == "" { log_fatal("Empty password") }
+	return password
+}
+
+// h3tunnel useradd|userdel|passwd|list [-users_file file] [-password pw] [-password_hash hash] [user] [options]
+func run_user_cmd(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.StringVar(&cfg.users_file, "users_file", "users.db", "User database")
+	flags.StringVar(&cfg.password_hash, "password_hash", "argon2id", "Hash for new passwords: argon2id or bcrypt")
+	password := flags.String("password", "", "Password, read from stdin if not given")
+	flags.Parse(args)
+	args = flags.Args()
+
+	if command != "list" && len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: h3tunnel %s [-users_file file] user\n", command)
+		os.Exit(2)
+	}
+
+	var err error
+	switch command {
+	case "useradd":
+		username := args[0]
+		if strings.ContainsAny(username, ": \t#") { log_fatal("Invalid user name %s", username) }
+		hash := hash_password(read_new_password(*password))
+		err = userdb_edit(cfg.users_file, func(lines []string) ([]string, error) {
+			if userdb_find(lines, username) >= 0 { return nil, errors.New("User "+username+" already exists") }
+			line := strings.Join(append([]string{ username + ": " + hash }, args[1:]...), " ")
+			return append(lines, line), nil
+		})
+	case "passwd":
+		err = userdb_set_password(cfg.users_file, args[0], "", hash_password(read_new_password(*password)))
+	case "userdel":
+		err = userdb_edit(cfg.users_file, func(lines []string) ([]string, error) {
+			i := userdb_find(lines, args[0])
+			if i < 0 { return nil, errors.New("User "+args[0]+" not found") }
+			return append(lines[:i], lines[i+1:]...), nil
+		})
+	case "list":
+		var users[] string
+		for username, value := range read_config(cfg.users_file, false) {
+			hash := "disabled"
+			password, disabled, options := split_user_fields(value)
+			if !disabled {
+				hash = "legacy"
+				if is_bcrypt_hash(password) {
+					hash = "bcrypt"
+				} else if !is_legacy_hash(password) {
+					hash = strings.Split(password, "$")[1]
+				}
+			}
+			users = append(users, fmt.Sprintf("%s\t%s\t%s", username, hash, strings.Join(options, " ")))
+		}
+		sort.Strings(users)
+		for _, user := range users {
+			fmt.Println(user)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %s\n", command, err.Error())
+		os.Exit(1)
+	}
+}
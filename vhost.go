@@ -0,0 +1,222 @@
+//go:build server
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+/*
+Virtual host file in the format of the configuration file:
+  hostname: SNI names, a leading *. matches any subdomain
+  cert, key, ca, client_ca, client_auth: TLS and mutual authentication, cert is
+    required as ACME only serves the main configuration
+  users_file, leases_file: user and lease database
+  pool, routes: address pool and routes sent to clients
+  dev: separate tun device, empty to share the main one
+  bearer: true to accept bearer tokens, verified with the settings of the main configuration
+Identity rules, bearer token settings, CRLs and pool limits are shared.
+*/
+
+var VHOST_OPTIONS = []string{
+	"hostname", "cert", "key", "ca", "client_ca", "client_auth",
+	"users_file", "leases_file", "pool", "routes", "dev", "bearer",
+}
+
+// Parts of a virtual host loaded before switching over
+type vhostConfig struct {
+	hostnames[] string
+	client_auth bool
+	bearer bool
+	users_file string
+	leases_file string
+	dev string
+	tls_config *tls.Config
+	users map[string]*userEntry
+	networks[] netip.Prefix
+	pool[] ipam_addr
+	routes[] netip.Prefix
+}
+
+func read_vhost(filename string) (*vhostConfig, error) {
+	options := read_config(filename, false)
+	for key := range options {
+		if !slices.Contains(VHOST_OPTIONS, key) {
+			log_warn("Ignoring unknown option %s in %s", key, filename)
+		}
+	}
+
+	c := &vhostConfig{
+		hostnames: strings.Fields(strings.ToLower(options["hostname"])),
+		client_auth: options["client_auth"] == "true",
+		bearer: options["bearer"] == "true",
+		users_file: options["users_file"],
+		leases_file: options["leases_file"],
+		dev: options["dev"],
+	}
+	if len(c.hostnames) == 0 { return nil, errors.New("No hostname in virtual host "+filename) }
+
+	settings := tlsSettings{
+		cert: options["cert"],
+		key: options["key"],
+		ca: options["ca"],
+		client_ca: options["client_ca"],
+		client_auth: c.client_auth,
+	}
+	if settings.cert == "" { return nil, errors.New("No certificate for virtual host "+filename) }
+	tls_config, err := load_tls_settings(settings)
+	if err != nil { return nil, err }
+	if c.client_auth {
+		tls_config.VerifyConnection = verify_connection
+	}
+	c.tls_config = tls_config
+
+	c.users = map[string]*userEntry{}
+	if c.users_file != "" {
+		c.users, err = read_userdb(c.users_file)
+		if err != nil { return nil, err }
+	}
+
+	c.networks, c.pool, err = ipam_build(options["pool"], rcfg())
+	if err != nil { return nil, fmt.Errorf("Invalid pool in %s: %s", filename, err.Error()) }
+	c.routes = append(slices.Clone(c.networks), parse_prefixes(options["routes"])...)
+	return c, nil
+}
+
+// Pools of all hosts share the forwarding table and must not overlap
+func check_vhost_networks(host *vhost, networks []netip.Prefix) error {
+	for _, other := range all_hosts() {
+		if other == host { continue }
+		for _, network := range networks {
+			for _, used := range other.ipam_networks() {
+				if network.Overlaps(used) {
+					return fmt.Errorf("Pool %s overlaps %s of %s", network.String(), used.String(), other.name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func vhost_init() {
+	for _, filename := range strings.Fields(cfg.vhosts) {
+		c, err := read_vhost(filename)
+		if err != nil { log_fatal("Cant load virtual host: %s", err.Error()) }
+
+		for _, hostname := range c.hostnames {
+			if find_vhost(hostname) != default_host {
+				log_fatal("Hostname %s of %s configured twice", hostname, filename)
+			}
+		}
+
+		host := &vhost{
+			name: c.hostnames[0],
+			config_file: filename,
+			hostnames: c.hostnames,
+			users_file: c.users_file,
+			leases_file: c.leases_file,
+			client_auth: c.client_auth,
+			dev: c.dev,
+			users: c.users,
+			routes: c.routes,
+		}
+		err = check_vhost_networks(host, c.networks)
+		if err != nil { log_fatal("%s", err.Error()) }
+		host.ipam.networks = c.networks
+		host.ipam.pool = c.pool
+		host.ipam.released = make(chan struct{})
+		host.ipam_load_leases()
+		host.tls.Store(c.tls_config)
+		host.bearer.Store(c.bearer)
+
+		if host.dev != "" {
+			dev := create_tun(host.dev)
+			host.dev = dev.name
+			host.uplink = NewConnection(dev, nil, "", nil, host)
+			err = AddConnection(host.uplink)
+			if err != nil { log_fatal("Failed to add tun device %s: %s", host.dev, err.Error()) }
+		} else {
+			host.dev = cfg.dev
+		}
+		for _, network := range c.networks {
+			err := setup_ip(host.dev, network)
+			if err != nil { log_fatal("Failed to configure tun device: %s", err.Error()) }
+		}
+
+		log_info("Virtual host %s with %d users on dev %s", strings.Join(host.hostnames, " "), len(host.users), host.dev)
+		vhosts = append(vhosts, host)
+	}
+}
+
+// A wildcard stands for exactly one label
+func vhost_matches(pattern string, server_name string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		label, found := strings.CutSuffix(server_name, pattern[1:])
+		return found && label != "" && !strings.Contains(label, ".")
+	}
+	return pattern == server_name
+}
+
+// Host serving the SNI name, exact names take precedence over wildcards
+func find_vhost(server_name string) *vhost {
+	server_name = strings.ToLower(strings.TrimSuffix(server_name, "."))
+	if server_name == "" { return default_host }
+
+	var wildcard *vhost
+	for _, host := range vhosts {
+		for _, pattern := range host.hostnames {
+			if pattern == server_name { return host }
+			if wildcard == nil && vhost_matches(pattern, server_name) { wildcard = host }
+		}
+	}
+	if wildcard != nil { return wildcard }
+	return default_host
+}
+
+// Bearer tokens are accepted by the main configuration when a JWKS is set and by virtual hosts enabling them
+func (h *vhost) bearer_enabled() bool {
+	if rcfg().jwt_jwks == "" { return false }
+	return h == default_host || h.bearer.Load()
+}
+
+// Hostnames and tun device are kept, everything else is replaced
+func (h *vhost) reload() error {
+	c, err := read_vhost(h.config_file)
+	if err != nil { return err }
+	err = check_vhost_networks(h, c.networks)
+	if err != nil { return err }
+	if c.client_auth != h.client_auth {
+		return errors.New("Changing client_auth of "+h.name+" needs a restart")
+	}
+	if !slices.Equal(c.hostnames, h.hostnames) || c.dev != "" && c.dev != h.dev {
+		log_warn("Hostname or device change of %s needs a restart", h.name)
+	}
+
+	h.tls.Store(c.tls_config)
+	h.bearer.Store(c.bearer)
+	users_sync.Lock()
+	h.users = c.users
+	h.users_file = c.users_file
+	users_sync.Unlock()
+
+	old_networks := h.ipam_networks()
+	h.ipam_reload(c.networks, c.pool)
+	for _, network := range c.networks {
+		if slices.Contains(old_networks, network) { continue }
+		err = setup_ip(h.dev, network)
+		if err != nil { log_err("Failed to add pool network %s: %s", network.String(), err.Error()) }
+	}
+	for _, network := range old_networks {
+		if slices.Contains(c.networks, network) { continue }
+		err = remove_ip(h.dev, network)
+		if err != nil { log_err("Failed to remove pool network %s: %s", network.String(), err.Error()) }
+	}
+	h.set_routes(c.routes)
+
+	log_info("Reloaded virtual host %s with %d users and %d routes", h.name, len(c.users), len(c.routes))
+	return nil
+}
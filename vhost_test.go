@@ -0,0 +1,121 @@
+//go:build server
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVhostBearer(t *testing.T) {
+	enabled := &vhost{ name: "enabled" }
+	enabled.bearer.Store(true)
+	disabled := &vhost{ name: "disabled" }
+
+	tests := []struct {
+		jwks string
+		host *vhost
+		bearer bool
+	}{
+		{ "", default_host, false },
+		{ "", enabled, false },
+		{ "jwks.json", default_host, true },
+		{ "jwks.json", enabled, true },
+		{ "jwks.json", disabled, false },
+	}
+	for _, test := range tests {
+		use_reload_config(t, reloadConfig{ jwt_jwks: test.jwks })
+		if test.host.bearer_enabled() != test.bearer {
+			t.Errorf("Bearer on %s with JWKS %q is %v, want %v", test.host.name, test.jwks, !test.bearer, test.bearer)
+		}
+	}
+}
+
+func TestVhostMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name string
+		match bool
+	}{
+		{ "vpn.example.com", "vpn.example.com", true },
+		{ "vpn.example.com", "example.com", false },
+		{ "*.example.com", "a.example.com", true },
+		{ "*.example.com", "example.com", false },
+		{ "*.example.com", "a.b.example.com", false },
+		{ "*.example.com", ".example.com", false },
+		{ "*.example.com", "aexample.com", false },
+	}
+	for _, test := range tests {
+		if vhost_matches(test.pattern, test.name) != test.match {
+			t.Errorf("vhost_matches(%q, %q) = %v", test.pattern, test.name, !test.match)
+		}
+	}
+}
+
+func TestFindVhost(t *testing.T) {
+	old := vhosts
+	t.Cleanup(func() { vhosts = old })
+	exact := &vhost{ name: "exact", hostnames: []string{ "a.example.com" } }
+	wildcard := &vhost{ name: "wildcard", hostnames: []string{ "other.example.net", "*.example.com" } }
+	vhosts = []*vhost{ wildcard, exact }
+
+	tests := []struct {
+		name string
+		host *vhost
+	}{
+		{ "a.example.com", exact },
+		{ "A.Example.COM.", exact },
+		{ "b.example.com", wildcard },
+		{ "other.example.net", wildcard },
+		{ "example.com", default_host },
+		{ "a.b.example.com", default_host },
+		{ "", default_host },
+	}
+	for _, test := range tests {
+		if host := find_vhost(test.name); host != test.host {
+			t.Errorf("find_vhost(%q) = %s, want %s", test.name, host.name, test.host.name)
+		}
+	}
+}
+
+func TestReadVhost(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := write_test_server_cert(t, dir)
+	use_reload_config(t, reloadConfig{ max_pool_size: 10, delegate_length: 128 })
+	users := filepath.Join(dir, "users.db")
+	err := os.WriteFile(users, []byte("alice: secret\nbob: other\n"), 0600)
+	if err != nil { t.Fatal(err) }
+
+	write := func(lines ...string) string {
+		filename := filepath.Join(dir, "vhost.cfg")
+		err := os.WriteFile(filename, []byte(strings.Join(lines, "\n") + "\n"), 0600)
+		if err != nil { t.Fatal(err) }
+		return filename
+	}
+
+	c, err := read_vhost(write("hostname: VPN.example.com *.example.org", "cert: "+cert, "key: "+key,
+		"users_file: "+users, "pool: 10.20.0.1/24", "routes: 192.168.0.0/16", "bearer: true", "unknown: 1"))
+	if err != nil { t.Fatal(err) }
+	if strings.Join(c.hostnames, " ") != "vpn.example.com *.example.org" || len(c.users) != 2 || !c.bearer || c.client_auth {
+		t.Errorf("Read hostnames %v, %d users, bearer %v, client_auth %v", c.hostnames, len(c.users), c.bearer, c.client_auth)
+	}
+	if len(c.networks) != 1 || len(c.routes) != 2 || c.routes[1].String() != "192.168.0.0/16" {
+		t.Errorf("Read networks %v and routes %v", c.networks, c.routes)
+	}
+
+	tests := []struct {
+		name string
+		lines[] string
+	}{
+		{ "no hostname", []string{ "cert: "+cert, "key: "+key, "pool: 10.20.0.1/24" } },
+		{ "no certificate", []string{ "hostname: vpn.example.com", "pool: 10.20.0.1/24" } },
+		{ "no pool", []string{ "hostname: vpn.example.com", "cert: "+cert, "key: "+key } },
+		{ "missing users file", []string{ "hostname: vpn.example.com", "cert: "+cert, "key: "+key, "pool: 10.20.0.1/24", "users_file: "+filepath.Join(dir, "missing.db") } },
+		{ "client auth without CA", []string{ "hostname: vpn.example.com", "cert: "+cert, "key: "+key, "pool: 10.20.0.1/24", "client_auth: true" } },
+	}
+	for _, test := range tests {
+		_, err := read_vhost(write(test.lines...))
+		if err == nil { t.Errorf("%s: accepted", test.name) }
+	}
+}